@@ -0,0 +1,329 @@
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+IssueKind is the category of an inconsistency found by Check.
+*/
+type IssueKind int
+
+/*
+Possible categories of inconsistencies.
+*/
+const (
+	// IssueMissingStaticInfo is a tracked path without staticinfo.
+	IssueMissingStaticInfo IssueKind = iota
+	// IssueUntrackedStaticInfo is a staticinfo without tracked path.
+	IssueUntrackedStaticInfo
+	// IssueMissingOnDisk is a tracked object that doesn't exist on disk.
+	IssueMissingOnDisk
+	// IssueContentMismatch is a file whose content differs from the stored hash although size and modtime are unchanged, so updates won't detect it.
+	IssueContentMismatch
+	// IssueDuplicateIdentification is an identification used by more than one object.
+	IssueDuplicateIdentification
+	// IssueBadRemoval is a malformed entry in the removal directory.
+	IssueBadRemoval
+	// IssueIndexMismatch is an identification index entry that doesn't match the staticinfos.
+	IssueIndexMismatch
+)
+
+/*
+String returns a readable name of the category.
+*/
+func (k IssueKind) String() string {
+	switch k {
+	case IssueMissingStaticInfo:
+		return "missing staticinfo"
+	case IssueUntrackedStaticInfo:
+		return "untracked staticinfo"
+	case IssueMissingOnDisk:
+		return "missing on disk"
+	case IssueContentMismatch:
+		return "content mismatch"
+	case IssueDuplicateIdentification:
+		return "duplicate identification"
+	case IssueBadRemoval:
+		return "bad removal"
+	case IssueIndexMismatch:
+		return "index mismatch"
+	}
+	return "unknown"
+}
+
+/*
+Issue is a single inconsistency found by Check. Repaired is true if it has been
+fixed.
+*/
+type Issue struct {
+	Kind           IssueKind
+	Path           string
+	Identification string
+	Repaired       bool
+}
+
+/*
+Check verifies the model against itself, the disk, and the removal directory and
+returns all inconsistencies found. If repair is set, everything that is safe to
+fix is fixed: missing staticinfos are rebuilt as local creates, dangling entries
+are dropped, staticinfos of existing objects are tracked again, removal
+directories are completed, and the identification index is rebuilt. Existing
+identifications are never changed. Missing objects, content mismatches, duplicate
+identifications, and removals of tracked objects are only reported; the first
+two are applied by the next update as usual. Files are hashed without holding
+the lock, so changes can be applied meanwhile.
+*/
+func (m *Model) Check(repair bool) ([]Issue, error) {
+	m.mutex.RLock()
+	candidates := m.contentCandidates()
+	m.mutex.RUnlock()
+	mismatches := hashCandidates(m.RootPath, candidates)
+	if repair {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+	} else {
+		m.mutex.RLock()
+		defer m.mutex.RUnlock()
+	}
+	if m.TrackedPaths == nil || m.StaticInfos == nil {
+		return nil, shared.ErrNilInternalState
+	}
+	var issues []Issue
+	issues = append(issues, m.checkEntries(repair)...)
+	issues = append(issues, m.checkContent(mismatches)...)
+	issues = append(issues, m.checkIdentifications(repair)...)
+	removals, err := m.checkRemovals(repair)
+	if err != nil {
+		return nil, err
+	}
+	issues = append(issues, removals...)
+	for _, issue := range issues {
+		fields := Fields{Path: issue.Path, Identification: issue.Identification, Operation: "check"}
+		if issue.Repaired {
+			m.info("Check: repaired "+issue.Kind.String()+".", fields)
+		} else {
+			m.warn("Check: "+issue.Kind.String()+"!", fields)
+		}
+	}
+	if repair {
+		err = m.persist()
+		if err != nil {
+			return issues, err
+		}
+	}
+	return issues, nil
+}
+
+/*
+checkEntries verifies that tracked paths and staticinfos agree with each other
+and with the disk.
+*/
+func (m *Model) checkEntries(repair bool) []Issue {
+	relPath := shared.CreatePathRoot(m.RootPath)
+	subpaths := make(map[string]bool)
+	for subpath := range m.TrackedPaths {
+		subpaths[subpath] = true
+	}
+	for subpath := range m.StaticInfos {
+		subpaths[subpath] = true
+	}
+	var issues []Issue
+	for _, subpath := range sortedSet(subpaths) {
+		_, tracked := m.TrackedPaths[subpath]
+		stin, hasStin := m.StaticInfos[subpath]
+		onDisk, _ := shared.ObjectExists(relPath.Apply(subpath).FullPath())
+		switch {
+		case !hasStin:
+			issue := Issue{Kind: IssueMissingStaticInfo, Path: subpath}
+			if repair {
+				if onDisk {
+					// a fresh object for the peers as the identification is lost anyway
+					issue.Repaired = m.applyCreate(relPath.Apply(subpath), nil, nil) == nil
+				} else {
+					m.removeObject(subpath)
+					issue.Repaired = true
+				}
+			}
+			issues = append(issues, issue)
+		case !tracked:
+			issue := Issue{Kind: IssueUntrackedStaticInfo, Path: subpath, Identification: stin.Identification}
+			if repair {
+				if onDisk {
+					m.setObject(subpath, stin)
+				} else {
+					m.removeObject(subpath)
+				}
+				issue.Repaired = true
+			}
+			issues = append(issues, issue)
+		case !onDisk:
+			issues = append(issues, Issue{Kind: IssueMissingOnDisk, Path: subpath, Identification: stin.Identification})
+		}
+	}
+	return issues
+}
+
+/*
+contentCandidates returns all files whose size and modtime match the model, as
+only hashing can tell whether their content does too. Other files are simply
+modified, which updates detect anyway.
+*/
+func (m *Model) contentCandidates() map[string]staticinfo {
+	relPath := shared.CreatePathRoot(m.RootPath)
+	candidates := make(map[string]staticinfo)
+	for subpath := range m.TrackedPaths {
+		stin, exists := m.StaticInfos[subpath]
+		if !exists || stin.Directory {
+			continue
+		}
+		stat, err := os.Lstat(relPath.Apply(subpath).FullPath())
+		if err != nil || stat.IsDir() || stat.Size() != stin.Size || !stat.ModTime().Equal(stin.Modtime) {
+			continue
+		}
+		candidates[subpath] = stin
+	}
+	return candidates
+}
+
+/*
+hashCandidates hashes the candidates and returns those whose content doesn't
+match. Reads only the disk, so the model must not be locked.
+*/
+func hashCandidates(root string, candidates map[string]staticinfo) map[string]staticinfo {
+	relPath := shared.CreatePathRoot(root)
+	mismatches := make(map[string]staticinfo)
+	for subpath, stin := range candidates {
+		hash, err := shared.ContentHash(relPath.Apply(subpath).FullPath())
+		if err != nil || hash == stin.Content {
+			continue
+		}
+		mismatches[subpath] = stin
+	}
+	return mismatches
+}
+
+/*
+checkContent reports the mismatches that are still current: objects changed
+while hashing have been updated meanwhile and are checked again next time.
+*/
+func (m *Model) checkContent(mismatches map[string]staticinfo) []Issue {
+	var issues []Issue
+	for _, subpath := range sortedSet(m.TrackedPaths) {
+		hashed, exists := mismatches[subpath]
+		if !exists {
+			continue
+		}
+		stin, exists := m.StaticInfos[subpath]
+		if !exists || stin.Identification != hashed.Identification || stin.Content != hashed.Content {
+			continue
+		}
+		issues = append(issues, Issue{Kind: IssueContentMismatch, Path: subpath, Identification: stin.Identification})
+	}
+	return issues
+}
+
+/*
+checkIdentifications reports identifications used more than once and verifies
+the identification index.
+*/
+func (m *Model) checkIdentifications(repair bool) []Issue {
+	subpaths := make(map[string]bool)
+	owners := make(map[string][]string)
+	for subpath, stin := range m.StaticInfos {
+		subpaths[subpath] = true
+		owners[stin.Identification] = append(owners[stin.Identification], subpath)
+	}
+	var issues []Issue
+	for _, subpath := range sortedSet(subpaths) {
+		id := m.StaticInfos[subpath].Identification
+		if len(owners[id]) > 1 {
+			issues = append(issues, Issue{Kind: IssueDuplicateIdentification, Path: subpath, Identification: id})
+		}
+	}
+	var mismatched []Issue
+	for id, subpath := range m.ids {
+		// duplicates can only be indexed once, so any of them is fine
+		if stin, exists := m.StaticInfos[subpath]; !exists || stin.Identification != id {
+			mismatched = append(mismatched, Issue{Kind: IssueIndexMismatch, Path: subpath, Identification: id})
+		}
+	}
+	for id, owned := range owners {
+		if _, indexed := m.ids[id]; !indexed {
+			mismatched = append(mismatched, Issue{Kind: IssueIndexMismatch, Path: owned[0], Identification: id})
+		}
+	}
+	sort.Sort(sortableIssues(mismatched))
+	if repair && len(mismatched) > 0 {
+		m.indexIdentifications()
+		for i := range mismatched {
+			mismatched[i].Repaired = true
+		}
+	}
+	return append(issues, mismatched...)
+}
+
+/*
+checkRemovals verifies that every entry of the removal directory is a complete
+removal directory and that no removal that has been applied locally is still
+tracked.
+*/
+func (m *Model) checkRemovals(repair bool) ([]Issue, error) {
+	removeDir := m.RootPath + "/" + shared.TINZENITEDIR + "/" + shared.REMOVEDIR
+	entries, err := ioutil.ReadDir(removeDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var issues []Issue
+	for _, entry := range entries {
+		id := entry.Name()
+		path := shared.TINZENITEDIR + "/" + shared.REMOVEDIR + "/" + id
+		if !entry.IsDir() {
+			issues = append(issues, Issue{Kind: IssueBadRemoval, Path: path, Identification: id})
+			continue
+		}
+		checkExists, _ := shared.DirectoryExists(removeDir + "/" + id + "/" + shared.REMOVECHECKDIR)
+		doneExists, _ := shared.DirectoryExists(removeDir + "/" + id + "/" + shared.REMOVEDONEDIR)
+		if !checkExists || !doneExists {
+			issue := Issue{Kind: IssueBadRemoval, Path: path, Identification: id}
+			if repair {
+				issue.Repaired = shared.MakeDirectories(removeDir+"/"+id, shared.REMOVECHECKDIR, shared.REMOVEDONEDIR) == nil
+			}
+			issues = append(issues, issue)
+			continue
+		}
+		// applied locally means the object must be gone
+		applied, _ := shared.FileExists(removeDir + "/" + id + "/" + shared.REMOVEDONEDIR + "/" + m.SelfID)
+		if subpath, exists := m.ids[id]; applied && exists {
+			issues = append(issues, Issue{Kind: IssueBadRemoval, Path: subpath, Identification: id})
+		}
+	}
+	return issues, nil
+}
+
+/*
+sortedSet returns the members of the set in sorted order.
+*/
+func sortedSet(set map[string]bool) []string {
+	var list []string
+	for member := range set {
+		list = append(list, member)
+	}
+	return shared.SortString(list)
+}
+
+/*
+sortableIssues sorts issues by identification.
+*/
+type sortableIssues []Issue
+
+func (s sortableIssues) Len() int           { return len(s) }
+func (s sortableIssues) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s sortableIssues) Less(i, j int) bool { return s[i].Identification < s[j].Identification }
@@ -0,0 +1,201 @@
+package model
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+Sizes used for content defined chunking. Chunks are never smaller than the
+minimum (except for the last one) and never larger than the maximum, averaging
+at 2^chunkAverageBits bytes.
+*/
+const (
+	chunkMinSize     = 256 * 1024
+	chunkMaxSize     = 8 * 1024 * 1024
+	chunkAverageBits = 20
+)
+
+/*
+gearTable is the table of random values used by the rolling hash. It is
+generated from a fixed seed so that all peers find the same boundaries.
+*/
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	// splitmix64
+	seed := uint64(0x74696e7a656e6974)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		value := seed
+		value = (value ^ (value >> 30)) * 0xbf58476d1ce4e5b9
+		value = (value ^ (value >> 27)) * 0x94d049bb133111eb
+		table[i] = value ^ (value >> 31)
+	}
+	return table
+}()
+
+/*
+Block is a content defined chunk of a file, identified by its strong hash.
+*/
+type Block struct {
+	Offset int64
+	Size   int64
+	Hash   string
+}
+
+/*
+GetBlocks returns the block list of the file at the given path. If the model
+doesn't store the list (because Chunking is disabled) it is computed from disk.
+*/
+func (m *Model) GetBlocks(path *shared.RelativePath) ([]Block, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.getBlocks(path)
+}
+
+/*
+getBlocks is GetBlocks without locking.
+*/
+func (m *Model) getBlocks(path *shared.RelativePath) ([]Block, error) {
+	stin, exists := m.StaticInfos[path.SubPath()]
+	if !exists {
+		return nil, shared.ErrUntracked
+	}
+	if stin.Directory {
+		return nil, shared.ErrIllegalParameters
+	}
+	if stin.Blocks != nil {
+		return stin.Blocks, nil
+	}
+	return chunkFile(path.FullPath())
+}
+
+/*
+MissingBlocks compares the block list of a remote version of the file at path to
+the local one and returns all remote blocks whose content is not available
+locally. Only these must be transferred to reconstruct the remote version.
+*/
+func (m *Model) MissingBlocks(path *shared.RelativePath, remote []Block) ([]Block, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	local, err := m.getBlocks(path)
+	if err != nil {
+		return nil, err
+	}
+	return missingBlocks(local, remote), nil
+}
+
+/*
+missingBlocks returns the blocks of remote that are not contained in local.
+*/
+func missingBlocks(local, remote []Block) []Block {
+	known := make(map[string]bool)
+	for _, block := range local {
+		known[block.Hash] = true
+	}
+	var missing []Block
+	for _, block := range remote {
+		if !known[block.Hash] {
+			missing = append(missing, block)
+		}
+	}
+	return missing
+}
+
+/*
+chunkFile splits the file at path into content defined blocks using a gear based
+rolling hash.
+*/
+func chunkFile(path string) ([]Block, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return chunkReader(file)
+}
+
+/*
+hashAndChunk returns the content hash and the block list of everything read from
+reader, reading it only once. The hash is the same as that of shared.ContentHash.
+*/
+func hashAndChunk(reader io.Reader) (string, []Block, error) {
+	content := md5.New()
+	blocks, err := chunkReader(io.TeeReader(reader, content))
+	if err != nil {
+		return "", nil, err
+	}
+	return hex.EncodeToString(content.Sum(nil)), blocks, nil
+}
+
+/*
+contentHash returns the content hash of everything read from reader, the same as
+that of shared.ContentHash.
+*/
+func contentHash(reader io.Reader) (string, error) {
+	content := md5.New()
+	_, err := io.Copy(content, reader)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(content.Sum(nil)), nil
+}
+
+/*
+chunkReader splits everything read from reader into content defined blocks.
+*/
+func chunkReader(reader io.Reader) ([]Block, error) {
+	blocks := []Block{}
+	buffer := make([]byte, chunkMaxSize)
+	filled := 0
+	var offset int64
+	for {
+		// always fill the buffer so that each cut sees the maximum size
+		read, err := io.ReadFull(reader, buffer[filled:])
+		filled += read
+		done := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !done {
+			return nil, err
+		}
+		if filled == 0 {
+			break
+		}
+		cut := cutPoint(buffer[:filled])
+		hash := sha256.Sum256(buffer[:cut])
+		blocks = append(blocks, Block{
+			Offset: offset,
+			Size:   int64(cut),
+			Hash:   hex.EncodeToString(hash[:])})
+		offset += int64(cut)
+		// keep the rest for the next block
+		filled = copy(buffer, buffer[cut:filled])
+	}
+	return blocks, nil
+}
+
+/*
+cutPoint returns the length of the next block at the start of data.
+*/
+func cutPoint(data []byte) int {
+	if len(data) <= chunkMinSize {
+		return len(data)
+	}
+	limit := len(data)
+	if limit > chunkMaxSize {
+		limit = chunkMaxSize
+	}
+	var hash uint64
+	for i := chunkMinSize; i < limit; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		// the top bits depend on the last 64 bytes only, so boundaries are content defined
+		if hash>>(64-chunkAverageBits) == 0 {
+			return i + 1
+		}
+	}
+	return limit
+}
@@ -0,0 +1,478 @@
+package model
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+Conflict describes a conflict between the local and a remote version of an
+object. Path is the sub path of the object, holding the version that won the
+conflict, Copy the sub path of the conflict copy holding the version that lost.
+CopyLocal is true if the copy holds the local version. Conflicts that can't be
+resolved automatically, for example a remote move onto an existing object, have
+no Copy: the local object stays unchanged and the remote version is not kept.
+Conflicts follow moves of the object and its copy and are dropped once either is
+removed.
+*/
+type Conflict struct {
+	Path          string
+	Copy          string
+	CopyLocal     bool
+	LocalVersion  shared.Version
+	RemoteVersion shared.Version
+	Peer          string
+	Time          time.Time
+}
+
+/*
+Resolution defines which side of a conflict is kept when resolving it.
+*/
+type Resolution int
+
+/*
+Possible resolutions of a conflict.
+*/
+const (
+	// KeepLocal keeps the local version, removing the other one.
+	KeepLocal Resolution = iota
+	// KeepRemote keeps the remote version, removing the other one.
+	KeepRemote
+	// KeepBoth keeps both files.
+	KeepBoth
+)
+
+/*
+ListConflicts returns all currently known conflicts sorted by path.
+*/
+func (m *Model) ListConflicts() []Conflict {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var list []Conflict
+	for _, conflict := range m.Conflicts {
+		list = append(list, conflict)
+	}
+	sort.Sort(sortableConflicts(list))
+	return list
+}
+
+/*
+ResolveConflict resolves the conflict for the given path. The changes are applied
+as local operations, so peers are notified and versions are increased as usual.
+Conflicts without a copy can only be resolved with KeepLocal or KeepBoth, as the
+remote version isn't available; KeepRemote returns ErrNoRemoteVersion.
+*/
+func (m *Model) ResolveConflict(path *shared.RelativePath, resolution Resolution) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	conflict, exists := m.Conflicts[path.SubPath()]
+	if !exists {
+		return ErrNoConflict
+	}
+	copyPath := path.Apply(m.RootPath + "/" + conflict.Copy)
+	var err error
+	switch {
+	case conflict.Copy == "" && resolution == KeepRemote:
+		return ErrNoRemoteVersion
+	case conflict.Copy == "":
+		// nothing to do, the local object is kept as is
+	default:
+		err = m.resolveCopy(path, copyPath, conflict, resolution)
+	}
+	if err != nil {
+		return err
+	}
+	m.removeConflict(path.SubPath())
+	return m.persist()
+}
+
+/*
+resolveCopy resolves the conflict by removing the copy or replacing the object
+at path with it.
+*/
+func (m *Model) resolveCopy(path, copyPath *shared.RelativePath, conflict Conflict, resolution Resolution) error {
+	switch resolution {
+	case KeepBoth:
+		// nothing to do, both are already tracked
+	case KeepLocal, KeepRemote:
+		// the copy replaces the path only if it holds the version to keep
+		if (resolution == KeepLocal) == conflict.CopyLocal {
+			return m.takeCopy(path, copyPath)
+		}
+		return m.dropCopy(copyPath)
+	default:
+		return shared.ErrIllegalParameters
+	}
+	return nil
+}
+
+/*
+dropCopy removes the conflict copy at copyPath if it still exists.
+*/
+func (m *Model) dropCopy(copyPath *shared.RelativePath) error {
+	if !m.isTracked(copyPath.FullPath()) {
+		return nil
+	}
+	return m.applyRemove(copyPath, nil)
+}
+
+/*
+takeCopy replaces the object at path with the conflict copy at copyPath.
+*/
+func (m *Model) takeCopy(path, copyPath *shared.RelativePath) error {
+	if !m.isTracked(copyPath.FullPath()) || !m.isTracked(path.FullPath()) {
+		m.warn("ResolveConflict: conflict copy or original is gone!", Fields{Path: path.SubPath(), Operation: "resolve"})
+		return shared.ErrIllegalFileState
+	}
+	// move the content over the file and apply as local modify
+	err := os.Rename(copyPath.FullPath(), path.FullPath())
+	if err != nil {
+		return err
+	}
+	if m.isModified(path, nil) {
+		err = m.applyModify(path, nil, nil)
+		if err != nil {
+			return err
+		}
+	}
+	// the copy is gone now, so remove it from the model too
+	return m.applyRemove(copyPath, nil)
+}
+
+/*
+applyConflict resolves a conflict between the local object at path and the
+remote object. All peers resolve a conflict the same way so that they converge
+without sending each other new conflicting versions: the winning version (see
+conflictSide.wins) is kept at the path, the losing one is moved to a sibling
+conflict copy that is tracked as a new object. Name and identification of the
+copy only depend on the losing version, so every peer creates the same copy. The
+object at the path receives the merged version of both sides, which is not
+increased so that it doesn't conflict again. Local files that aren't tracked yet
+always lose. Deltas are never applied as they were made against a version the
+local file doesn't have, so the complete remote file is required. Directories
+can not be resolved this way and return shared.ErrConflict.
+*/
+func (m *Model) applyConflict(path *shared.RelativePath, remoteObject *shared.ObjectInfo) error {
+	if remoteObject.Directory {
+		m.recordConflict(path, remoteObject)
+		return shared.ErrConflict
+	}
+	remote := conflictSide{
+		version:        remoteObject.Version,
+		identification: remoteObject.Identification,
+		content:        remoteObject.Content}
+	local := conflictSide{version: shared.CreateVersion()}
+	stin, tracked := m.StaticInfos[path.SubPath()]
+	if tracked {
+		content, err := shared.ContentHash(path.FullPath())
+		if err != nil {
+			return err
+		}
+		local.version = mergeVersions(stin.Version, nil)
+		// local changes not yet applied would be sent with an increased version
+		if content != stin.Content {
+			local.version.Increase(m.SelfID)
+		}
+		local.identification = stin.Identification
+		local.content = content
+	}
+	remoteWins := !tracked || remote.wins(local)
+	winner, loser := local, remote
+	if remoteWins {
+		winner, loser = remote, local
+	}
+	// determine the conflict copy
+	copyID, err := loser.copyIdentification()
+	if err != nil {
+		return err
+	}
+	peer := conflictPeer(winner.version, loser.version)
+	if !tracked {
+		peer = m.SelfID
+	}
+	copyPath := m.conflictPath(path, peer, copyID)
+	m.info("Conflict resolved as "+copyPath.LastElement(), Fields{Path: path.SubPath(), Identification: remoteObject.Identification, Operation: "conflict", Peer: peer})
+	if remoteWins {
+		// keep the local version as copy and apply the remote one in its place
+		err = os.Rename(path.FullPath(), copyPath.FullPath())
+		if err != nil {
+			return err
+		}
+		err = m.applyFile(remote.identification, "", path.FullPath(), remote.content)
+		if err != nil {
+			// undo so that the local version is kept in place
+			os.Rename(copyPath.FullPath(), path.FullPath())
+			return err
+		}
+	} else {
+		err = m.applyFile(remote.identification, "", copyPath.FullPath(), remote.content)
+		if err != nil {
+			return err
+		}
+	}
+	// conflict copy is a new object that must be sent to all peers (notifies create)
+	err = m.trackCopy(copyPath, copyID)
+	if err != nil {
+		m.error("Conflict: failed to track conflict copy!", Fields{Path: copyPath.SubPath(), Operation: "conflict", Err: err})
+		return err
+	}
+	// remember the conflict until it is resolved
+	m.setConflict(Conflict{
+		Path:          path.SubPath(),
+		Copy:          copyPath.SubPath(),
+		CopyLocal:     remoteWins,
+		LocalVersion:  local.version,
+		RemoteVersion: mergeVersions(remote.version, nil),
+		Peer:          conflictPeer(local.version, remote.version),
+		Time:          time.Now()})
+	if !tracked {
+		newStin, err := createStaticInfo(path.FullPath(), m.SelfID, m.Chunking, nil)
+		if err != nil {
+			return err
+		}
+		stin = *newStin
+	}
+	// the path holds the winner with a version including both sides
+	stin.Identification = winner.identification
+	stin.Version = mergeVersions(local.version, remote.version)
+	err = stin.updateFromDisk(path.FullPath(), m.Chunking, nil)
+	if err != nil {
+		return err
+	}
+	m.setObject(path.SubPath(), stin)
+	localObj, err := m.getInfo(path)
+	if err != nil {
+		m.warn("Conflict: failed to retrieve ObjectInfo for notify!", Fields{Path: path.SubPath(), Operation: "conflict", Err: err})
+		return nil
+	}
+	// without a local object this is simply the remote create
+	if !tracked {
+		m.notify(shared.OpCreate, localObj)
+	} else {
+		m.notify(shared.OpModify, localObj)
+	}
+	return nil
+}
+
+/*
+recordConflict registers a conflict of the remote object with the object at path
+that is not resolved automatically, so no copy exists.
+*/
+func (m *Model) recordConflict(path *shared.RelativePath, remoteObject *shared.ObjectInfo) {
+	local := shared.CreateVersion()
+	if stin, exists := m.StaticInfos[path.SubPath()]; exists {
+		local = mergeVersions(stin.Version, nil)
+	}
+	m.info("Conflict registered without copy.", Fields{Path: path.SubPath(), Identification: remoteObject.Identification, Operation: "conflict"})
+	m.setConflict(Conflict{
+		Path:          path.SubPath(),
+		LocalVersion:  local,
+		RemoteVersion: mergeVersions(remoteObject.Version, nil),
+		Peer:          conflictPeer(local, remoteObject.Version),
+		Time:          time.Now()})
+}
+
+/*
+moveConflicts moves all conflicts of the object at from and its children, and of
+their copies, to the sub path to.
+*/
+func (m *Model) moveConflicts(from, to string) {
+	var moved []Conflict
+	for _, conflict := range m.Conflicts {
+		if withinPath(conflict.Path, from) || withinPath(conflict.Copy, from) {
+			moved = append(moved, conflict)
+		}
+	}
+	for _, conflict := range moved {
+		subpath := conflict.Path
+		if withinPath(conflict.Path, from) {
+			conflict.Path = to + strings.TrimPrefix(conflict.Path, from)
+		}
+		if withinPath(conflict.Copy, from) {
+			conflict.Copy = to + strings.TrimPrefix(conflict.Copy, from)
+		}
+		if conflict.Path != subpath {
+			m.removeConflict(subpath)
+		}
+		m.setConflict(conflict)
+	}
+}
+
+/*
+dropConflicts removes all conflicts of which the object or the copy is removed
+with the object at the sub path, as they can't be resolved anymore.
+*/
+func (m *Model) dropConflicts(subpath string) {
+	for path, conflict := range m.Conflicts {
+		if withinPath(conflict.Path, subpath) || withinPath(conflict.Copy, subpath) {
+			m.removeConflict(path)
+		}
+	}
+}
+
+/*
+withinPath returns true if the sub path is the object at dir or one of its
+children.
+*/
+func withinPath(subpath, dir string) bool {
+	if subpath == "" {
+		return false
+	}
+	return subpath == dir || strings.HasPrefix(subpath, dir+"/")
+}
+
+/*
+trackCopy tracks the conflict copy at path under the given identification and
+notifies its creation.
+*/
+func (m *Model) trackCopy(path *shared.RelativePath, identification string) error {
+	stin, err := createStaticInfo(path.FullPath(), m.SelfID, m.Chunking, nil)
+	if err != nil {
+		return err
+	}
+	stin.Identification = identification
+	m.setObject(path.SubPath(), *stin)
+	copyObj, err := m.getInfo(path)
+	if err != nil {
+		m.warn("Conflict: failed to retrieve ObjectInfo for notify!", Fields{Path: path.SubPath(), Operation: "conflict", Err: err})
+		return nil
+	}
+	m.notify(shared.OpCreate, copyObj)
+	return nil
+}
+
+/*
+conflictPath returns the path of the sibling to which the losing version is
+written. The name is of the form "name (conflict peer key).ext", where the key
+is the start of the identification of the copy. If that name is already taken a
+counter is added.
+*/
+func (m *Model) conflictPath(path *shared.RelativePath, peer, identification string) *shared.RelativePath {
+	name := path.LastElement()
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	// dot files have no extension
+	if base == "" {
+		base = name
+		ext = ""
+	}
+	key := identification
+	if len(key) > 8 {
+		key = key[:8]
+	}
+	// must be usable as part of a file name
+	marker := "conflict " + strings.Replace(peer, "/", "_", -1) + " " + key
+	parent := path.Up().FullPath()
+	candidate := path.Apply(parent + "/" + base + " (" + marker + ")" + ext)
+	for count := 2; ; count++ {
+		exists, _ := shared.ObjectExists(candidate.FullPath())
+		if !exists && !m.isTracked(candidate.FullPath()) {
+			return candidate
+		}
+		candidate = path.Apply(parent + "/" + base + " (" + marker + " " + strconv.Itoa(count) + ")" + ext)
+	}
+}
+
+/*
+conflictPeer determines the peer responsible for the remote version. This is
+the first peer that knows of changes we don't know of.
+*/
+func conflictPeer(local, remote shared.Version) string {
+	var candidates []string
+	for peer, value := range remote {
+		if value > local[peer] {
+			candidates = append(candidates, peer)
+		}
+	}
+	if len(candidates) == 0 {
+		return "unknown"
+	}
+	sort.Strings(candidates)
+	return candidates[0]
+}
+
+/*
+conflictSide is one of the two versions of a conflict.
+*/
+type conflictSide struct {
+	version        shared.Version
+	identification string
+	content        string
+}
+
+/*
+wins returns true if the side wins the conflict against the other side. All
+peers must come to the same result, so only values known to both are compared:
+the side with more changes wins, then the side changed by the peer with the
+smaller identification, then the side with the smaller identification and
+content.
+*/
+func (s conflictSide) wins(other conflictSide) bool {
+	if sum, otherSum := versionSum(s.version), versionSum(other.version); sum != otherSum {
+		return sum > otherSum
+	}
+	if peer, otherPeer := conflictPeer(other.version, s.version), conflictPeer(s.version, other.version); peer != otherPeer {
+		return peer < otherPeer
+	}
+	if s.identification != other.identification {
+		return s.identification < other.identification
+	}
+	return s.content <= other.content
+}
+
+/*
+copyIdentification returns the identification of the conflict copy for the side.
+It is derived from identification and version so that all peers use the same.
+Sides that aren't tracked are only known locally, so they get a new one.
+*/
+func (s conflictSide) copyIdentification() (string, error) {
+	if s.identification == "" {
+		return shared.NewIdentifier()
+	}
+	hash := sha256.Sum256([]byte(s.identification + "/" + versionKey(s.version)))
+	return hex.EncodeToString(hash[:16]), nil
+}
+
+/*
+versionSum returns the total number of changes of the version.
+*/
+func versionSum(version shared.Version) int {
+	sum := 0
+	for _, value := range version {
+		sum += value
+	}
+	return sum
+}
+
+/*
+sortableConflicts sorts conflicts by their path.
+*/
+type sortableConflicts []Conflict
+
+func (s sortableConflicts) Len() int           { return len(s) }
+func (s sortableConflicts) Less(i, j int) bool { return s[i].Path < s[j].Path }
+func (s sortableConflicts) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+/*
+mergeVersions returns a new version that includes both given versions.
+*/
+func mergeVersions(local, remote shared.Version) shared.Version {
+	merged := shared.CreateVersion()
+	for peer, value := range local {
+		merged[peer] = value
+	}
+	for peer, value := range remote {
+		if value > merged[peer] {
+			merged[peer] = value
+		}
+	}
+	return merged
+}
@@ -9,22 +9,32 @@ import (
 private errors
 */
 var (
-	errMismatch             = errors.New("mismatch in structs")
-	errModelInconsitent     = errors.New("model tracked and staticinfo are inconsistent")
-	errMissingUpdateFile    = errors.New("file for update missing from temp")
-	errIncompatibleModel    = errors.New("model is incompatible")
-	errParentObjectsMissing = errors.New("missing parent objects")
-	errObjectUntracked      = errors.New("object untracked")
-	errFilter               = errors.New("filter found illegal values")
+	errMismatch         = errors.New("mismatch in structs")
+	errWatchUnsupported = errors.New("watching is not supported on this platform")
+	errWatchLimit       = errors.New("watch limit reached")
 )
 
 /*
 public errors
 */
 var (
-	ErrIgnoreUpdate      = errors.New("update should be ignored")
-	ErrObjectRemoved     = errors.New("object removed")
-	ErrObjectRemovalDone = errors.New("object removal locally done")
+	ErrIgnoreUpdate         = errors.New("update should be ignored")
+	ErrObjectRemoved        = errors.New("object removed")
+	ErrObjectRemovalDone    = errors.New("object removal locally done")
+	ErrNoConflict           = errors.New("no conflict known for path")
+	ErrNoRemoteVersion      = errors.New("remote version of conflict is not available")
+	ErrIncompatibleModel    = errors.New("model was written by a newer version")
+	ErrModelInconsistent    = errors.New("model tracked and staticinfo are inconsistent")
+	ErrMissingUpdateFile    = errors.New("file for update missing from temp")
+	ErrModelCorrupt         = errors.New("model is corrupt")
+	ErrParentObjectsMissing = errors.New("missing parent objects")
+	ErrObjectUntracked      = errors.New("object untracked")
+	ErrFilter               = errors.New("filter found illegal values")
+	ErrDeltaCorrupt         = errors.New("delta file is corrupt")
+	ErrDeltaMismatch        = errors.New("delta result doesn't match content")
+	ErrNoHistory            = errors.New("no history kept for version")
+	ErrHistoryCorrupt       = errors.New("kept content doesn't match its history entry")
+	ErrPlanOutdated         = errors.New("disk or model changed since the plan was made")
 )
 
 var tag = "Model:"
@@ -0,0 +1,187 @@
+package model
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+Delta files consist of the header followed by a list of instructions. A copy
+instruction references a range of the old content by offset and size, a literal
+instruction carries its size followed by the new data itself. A delta for an
+object is expected in the TEMPDIR named as the object identification plus the
+deltaSuffix.
+*/
+const (
+	deltaHeader  = "TINZENITEDELTA1\n"
+	deltaSuffix  = ".delta"
+	deltaCopy    = 'C'
+	deltaLiteral = 'L'
+)
+
+/*
+CreateDelta writes a delta for the file at the given path to the writer. The
+remote block list describes the content the receiver already has, so only the
+blocks it is missing are written as literal data.
+*/
+func (m *Model) CreateDelta(path *shared.RelativePath, remote []Block, writer io.Writer) error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if !m.isTracked(path.FullPath()) {
+		return shared.ErrUntracked
+	}
+	return writeDelta(path.FullPath(), remote, writer)
+}
+
+/*
+writeDelta writes the delta of the file at path against the remote block list.
+*/
+func writeDelta(path string, remote []Block, writer io.Writer) error {
+	local, err := chunkFile(path)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	known := make(map[string]Block)
+	for _, block := range remote {
+		known[block.Hash] = block
+	}
+	buffered := bufio.NewWriter(writer)
+	_, err = buffered.WriteString(deltaHeader)
+	if err != nil {
+		return err
+	}
+	for _, block := range local {
+		if remoteBlock, exists := known[block.Hash]; exists {
+			// receiver has the content, so reference it
+			err = writeInstruction(buffered, deltaCopy, remoteBlock.Offset, remoteBlock.Size)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err = writeInstruction(buffered, deltaLiteral, block.Size)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(buffered, io.NewSectionReader(file, block.Offset, block.Size))
+		if err != nil {
+			return err
+		}
+	}
+	return buffered.Flush()
+}
+
+/*
+writeInstruction writes the instruction type followed by its values.
+*/
+func writeInstruction(writer io.Writer, instruction byte, values ...int64) error {
+	_, err := writer.Write([]byte{instruction})
+	if err != nil {
+		return err
+	}
+	return binary.Write(writer, binary.BigEndian, values)
+}
+
+/*
+applyDelta builds the new content from the delta and the file at basePath. The
+result is verified against the content hash and only then moved to targetPath,
+so the target is never left half written.
+*/
+func (m *Model) applyDelta(deltaPath, basePath, targetPath, content string) error {
+	delta, err := os.Open(deltaPath)
+	if err != nil {
+		return ErrMissingUpdateFile
+	}
+	defer delta.Close()
+	base, err := os.Open(basePath)
+	if err != nil {
+		// without the old content a delta can not be applied
+		return ErrMissingUpdateFile
+	}
+	defer base.Close()
+	// build the result next to the delta so that the final rename is atomic
+	resultPath := deltaPath + ".result"
+	result, err := os.OpenFile(resultPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, shared.FILEPERMISSIONMODE)
+	if err != nil {
+		return err
+	}
+	err = readDelta(bufio.NewReader(delta), base, result)
+	if err == nil {
+		err = result.Sync()
+	}
+	result.Close()
+	if err != nil {
+		os.Remove(resultPath)
+		return err
+	}
+	// verify before replacing anything
+	hash, err := shared.ContentHash(resultPath)
+	if err != nil || hash != content {
+		m.warn("Delta: patched content doesn't match!", Fields{Path: targetPath, Operation: "modify", Err: err})
+		os.Remove(resultPath)
+		return ErrDeltaMismatch
+	}
+	err = os.Rename(resultPath, targetPath)
+	if err != nil {
+		os.Remove(resultPath)
+		return err
+	}
+	// delta has been applied, so it isn't needed anymore
+	return os.Remove(deltaPath)
+}
+
+/*
+readDelta reads all instructions of the delta and writes the resulting content.
+*/
+func readDelta(delta *bufio.Reader, base io.ReaderAt, result io.Writer) error {
+	header := make([]byte, len(deltaHeader))
+	_, err := io.ReadFull(delta, header)
+	if err != nil || string(header) != deltaHeader {
+		return ErrDeltaCorrupt
+	}
+	for {
+		instruction, err := delta.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch instruction {
+		case deltaCopy:
+			var values [2]int64
+			err = binary.Read(delta, binary.BigEndian, &values)
+			if err != nil {
+				return ErrDeltaCorrupt
+			}
+			written, err := io.Copy(result, io.NewSectionReader(base, values[0], values[1]))
+			if err != nil {
+				return err
+			}
+			if written != values[1] {
+				return ErrDeltaCorrupt
+			}
+		case deltaLiteral:
+			var size int64
+			err = binary.Read(delta, binary.BigEndian, &size)
+			if err != nil {
+				return ErrDeltaCorrupt
+			}
+			_, err = io.CopyN(result, delta, size)
+			if err != nil {
+				return ErrDeltaCorrupt
+			}
+		default:
+			return ErrDeltaCorrupt
+		}
+	}
+}
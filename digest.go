@@ -0,0 +1,160 @@
+package model
+
+import (
+	"context"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+/*
+digest holds the hash (and if required the block list) of a file together with
+the size and modtime the file had when it was hashed.
+*/
+type digest struct {
+	size    int64
+	modtime time.Time
+	content string
+	blocks  []Block
+}
+
+/*
+digests are precomputed file digests by full path. They allow hashing to happen
+before the model is locked, see PartialUpdate. A nil digests is valid and simply
+computes everything on demand.
+*/
+type digests map[string]digest
+
+/*
+lookup returns the digest of the file at path with the given stat. The
+precomputed digest is only used if the file hasn't changed since, otherwise the
+file is hashed again.
+*/
+func (d digests) lookup(path string, stat os.FileInfo, chunked bool) (digest, error) {
+	known, exists := d[path]
+	if exists && known.size == stat.Size() && known.modtime.Equal(stat.ModTime()) && (!chunked || known.blocks != nil) {
+		return known, nil
+	}
+	return computeDigest(context.Background(), path, stat, chunked)
+}
+
+/*
+hash returns the content hash of the file at path.
+*/
+func (d digests) hash(path string) (string, error) {
+	stat, err := os.Lstat(path)
+	if err != nil {
+		return "", err
+	}
+	known, err := d.lookup(path, stat, false)
+	if err != nil {
+		return "", err
+	}
+	return known.content, nil
+}
+
+/*
+hashJob is a file to hash.
+*/
+type hashJob struct {
+	path string
+	stat os.FileInfo
+}
+
+/*
+hashFiles computes the digests of all jobs using the given number of workers,
+or one per CPU if not set. Files that fail to hash are left out, they are hashed
+again when applied. Returns ctx.Err() if the context is canceled.
+*/
+func hashFiles(ctx context.Context, jobs []hashJob, workers int, chunked bool) (digests, error) {
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+	queue := make(chan hashJob)
+	var mutex sync.Mutex
+	var wait sync.WaitGroup
+	prepared := make(digests)
+	for i := 0; i < workers; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for job := range queue {
+				fileDigest, err := computeDigest(ctx, job.path, job.stat, chunked)
+				if err != nil {
+					continue
+				}
+				mutex.Lock()
+				prepared[job.path] = fileDigest
+				mutex.Unlock()
+			}
+		}()
+	}
+	// feed the workers until done or canceled
+feed:
+	for _, job := range jobs {
+		select {
+		case <-ctx.Done():
+			break feed
+		case queue <- job:
+		}
+	}
+	close(queue)
+	wait.Wait()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return prepared, nil
+}
+
+/*
+computeDigest hashes the file at path with the given stat. Returns ctx.Err() if
+the context is canceled before the file has been read completely.
+*/
+func computeDigest(ctx context.Context, path string, stat os.FileInfo, chunked bool) (digest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return digest{}, err
+	}
+	defer file.Close()
+	reader := &contextReader{ctx: ctx, reader: file}
+	var hash string
+	var blocks []Block
+	// chunked files are hashed while chunking so that they are only read once
+	if chunked {
+		hash, blocks, err = hashAndChunk(reader)
+	} else {
+		hash, err = contentHash(reader)
+	}
+	if err != nil {
+		return digest{}, err
+	}
+	return digest{
+		size:    stat.Size(),
+		modtime: stat.ModTime(),
+		content: hash,
+		blocks:  blocks}, nil
+}
+
+/*
+contextReader reads from reader until the context is canceled, which is checked
+before every read.
+*/
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+/*
+Read reads from the underlying reader unless the context is canceled.
+*/
+func (c *contextReader) Read(data []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(data)
+}
@@ -0,0 +1,93 @@
+package model
+
+import (
+	"errors"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+Error is returned by all operations that apply or check changes. It carries the
+context of the failure while the cause can still be compared via errors.Is, for
+example against ErrIgnoreUpdate or shared.ErrConflict.
+*/
+type Error struct {
+	// Op is the operation that failed, for example "create" or "sync".
+	Op string
+	// Path is the sub path of the object, if known.
+	Path string
+	// Identification is the identification of the object, if known.
+	Identification string
+	// Err is the underlying cause.
+	Err error
+}
+
+/*
+Error returns a readable description including all known context.
+*/
+func (e *Error) Error() string {
+	msg := e.Op
+	if e.Path != "" {
+		msg += " " + e.Path
+	}
+	if e.Identification != "" {
+		msg += " (" + e.Identification + ")"
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+/*
+Unwrap returns the underlying cause.
+*/
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+/*
+operationName returns the name of the operation as used for Error.Op.
+*/
+func operationName(op shared.Operation) string {
+	switch op {
+	case shared.OpCreate:
+		return "create"
+	case shared.OpModify:
+		return "modify"
+	case shared.OpRemove:
+		return "remove"
+	}
+	return "unknown"
+}
+
+/*
+wrapError returns err with the given context. Errors that already carry context
+are returned unchanged so that the innermost context is kept. Returns nil for a
+nil err.
+*/
+func wrapError(op, path, identification string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var known *Error
+	if errors.As(err, &known) {
+		return err
+	}
+	return &Error{Op: op, Path: path, Identification: identification, Err: err}
+}
+
+/*
+wrapApply returns the error of an apply operation on path with context. The
+identification is taken from the remote object if given, otherwise from the
+model.
+*/
+func (m *Model) wrapApply(op string, path *shared.RelativePath, remoteObject *shared.ObjectInfo, err error) error {
+	if err == nil {
+		return nil
+	}
+	var identification string
+	if remoteObject != nil {
+		identification = remoteObject.Identification
+	} else if stin, exists := m.StaticInfos[path.SubPath()]; exists {
+		identification = stin.Identification
+	}
+	return wrapError(op, path.SubPath(), identification, err)
+}
@@ -0,0 +1,344 @@
+package model
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+Policy defines what happens to a new event if the buffer of a subscription is
+full.
+*/
+type Policy int
+
+/*
+Possible policies for full buffers.
+*/
+const (
+	// PolicyBlock waits until the subscriber reads, blocking the model meanwhile.
+	PolicyBlock Policy = iota
+	// PolicyDropOldest drops the oldest buffered event to make room.
+	PolicyDropOldest
+	// PolicyCoalesce replaces a buffered event of the same path, dropping the oldest if there is none.
+	PolicyCoalesce
+)
+
+/*
+Filter selects the events a subscription receives. Empty Operations match all
+operations, an empty Prefix all paths. Prefix is a sub path, matching the object
+itself and everything within it.
+*/
+type Filter struct {
+	Operations []shared.Operation
+	Prefix     string
+}
+
+/*
+Event is a single change of the model. Dropped is the number of events that
+were dropped for this subscription since the previous event due to a full
+buffer.
+*/
+type Event struct {
+	Message shared.UpdateMessage
+	Dropped int
+}
+
+/*
+Subscription receives the events of the model that match its filter. Blocking
+subscriptions buffer in their channel. All others keep the buffer themselves so
+that buffered events can still be dropped or replaced, and hand one event at a
+time to the channel, see forward.
+*/
+type Subscription struct {
+	bus      *eventBus
+	filter   Filter
+	policy   Policy
+	events   chan Event
+	legacy   chan shared.UpdateMessage
+	mutex    sync.Mutex
+	closed   bool
+	size     int
+	queue    []queuedEvent
+	sequence int64
+	changed  chan bool
+	stopped  chan bool
+	dropped  int
+	done     chan bool
+	once     sync.Once
+}
+
+/*
+queuedEvent is an event buffered by the subscription. The sequence identifies it
+even if its position changes.
+*/
+type queuedEvent struct {
+	sequence int64
+	event    Event
+}
+
+/*
+eventBus distributes events to all subscriptions.
+*/
+type eventBus struct {
+	mutex         sync.Mutex
+	subscriptions []*Subscription
+}
+
+/*
+Subscribe returns a new subscription for all events matching the filter. Up to
+size events are buffered, after which the policy applies. PolicyDropOldest and
+PolicyCoalesce require a buffer.
+*/
+func (m *Model) Subscribe(filter Filter, size int, policy Policy) (*Subscription, error) {
+	if size < 0 || (size == 0 && policy != PolicyBlock) || policy < PolicyBlock || policy > PolicyCoalesce {
+		return nil, shared.ErrIllegalParameters
+	}
+	bus := m.getBus()
+	sub := &Subscription{
+		bus:    bus,
+		filter: filter,
+		policy: policy,
+		done:   make(chan bool)}
+	if policy == PolicyBlock {
+		sub.events = make(chan Event, size)
+	} else {
+		sub.events = make(chan Event)
+		sub.size = size
+		sub.changed = make(chan bool, 1)
+		sub.stopped = make(chan bool)
+		go sub.forward()
+	}
+	bus.add(sub)
+	return sub, nil
+}
+
+/*
+Events returns the channel over which the events are received. It is closed once
+the subscription is closed.
+*/
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+/*
+Close ends the subscription. Buffered events are discarded.
+*/
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		// release any blocked publish first
+		close(s.done)
+		s.bus.remove(s)
+		s.mutex.Lock()
+		s.closed = true
+		s.queue = nil
+		s.mutex.Unlock()
+		// the channel may only be closed once nothing writes to it anymore
+		if s.stopped != nil {
+			<-s.stopped
+		}
+		if s.legacy == nil {
+			close(s.events)
+		}
+	})
+}
+
+/*
+getBus returns the event bus of the model, creating it if required.
+*/
+func (m *Model) getBus() *eventBus {
+	m.busOnce.Do(func() {
+		m.bus = &eventBus{}
+	})
+	return m.bus
+}
+
+/*
+register replaces the subscription of Register with one writing to the channel.
+*/
+func (m *Model) register(v chan shared.UpdateMessage) {
+	if m.registered != nil {
+		m.registered.Close()
+		m.registered = nil
+	}
+	if v == nil {
+		return
+	}
+	bus := m.getBus()
+	sub := &Subscription{
+		bus:    bus,
+		policy: PolicyBlock,
+		legacy: v,
+		done:   make(chan bool)}
+	bus.add(sub)
+	m.registered = sub
+}
+
+/*
+add the subscription to the bus.
+*/
+func (b *eventBus) add(sub *Subscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subscriptions = append(b.subscriptions, sub)
+}
+
+/*
+remove the subscription from the bus.
+*/
+func (b *eventBus) remove(sub *Subscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for i, candidate := range b.subscriptions {
+		if candidate == sub {
+			b.subscriptions = append(b.subscriptions[:i], b.subscriptions[i+1:]...)
+			return
+		}
+	}
+}
+
+/*
+publish the message to all matching subscriptions. The bus isn't locked while
+delivering, so that a blocking subscription never stalls subscribing or closing.
+*/
+func (b *eventBus) publish(msg shared.UpdateMessage) {
+	b.mutex.Lock()
+	subscriptions := make([]*Subscription, len(b.subscriptions))
+	copy(subscriptions, b.subscriptions)
+	b.mutex.Unlock()
+	for _, sub := range subscriptions {
+		if sub.matches(msg) {
+			sub.deliver(msg)
+		}
+	}
+}
+
+/*
+matches returns true if the message passes the filter.
+*/
+func (s *Subscription) matches(msg shared.UpdateMessage) bool {
+	if len(s.filter.Operations) > 0 {
+		found := false
+		for _, op := range s.filter.Operations {
+			if op == msg.Operation {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	prefix := s.filter.Prefix
+	return prefix == "" || msg.Object.Path == prefix || strings.HasPrefix(msg.Object.Path, prefix+"/")
+}
+
+/*
+deliver the message according to the policy. Deliveries to the subscription are
+serialized so that the order of events is kept.
+*/
+func (s *Subscription) deliver(msg shared.UpdateMessage) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+	if s.legacy != nil {
+		select {
+		case s.legacy <- msg:
+		case <-s.done:
+		}
+		return
+	}
+	if s.policy == PolicyBlock {
+		select {
+		case s.events <- Event{Message: msg, Dropped: s.dropped}:
+			s.dropped = 0
+		case <-s.done:
+		}
+		return
+	}
+	s.enqueue(msg)
+	// wake the forwarder, one pending wake up is enough
+	select {
+	case s.changed <- true:
+	default:
+	}
+}
+
+/*
+enqueue buffers the message, dropping or replacing a buffered event if the
+buffer is full. Must be called with the subscription locked.
+*/
+func (s *Subscription) enqueue(msg shared.UpdateMessage) {
+	if len(s.queue) == s.size {
+		if s.policy == PolicyCoalesce && s.coalesce(msg) {
+			return
+		}
+		// full, so drop the oldest
+		s.queue = s.queue[1:]
+		s.dropped++
+	}
+	s.sequence++
+	s.queue = append(s.queue, queuedEvent{
+		sequence: s.sequence,
+		event:    Event{Message: msg, Dropped: s.dropped}})
+	s.dropped = 0
+}
+
+/*
+coalesce replaces a buffered event of the same path with the message, keeping
+the order of all others. Returns false if no such event is buffered. Must be
+called with the subscription locked.
+*/
+func (s *Subscription) coalesce(msg shared.UpdateMessage) bool {
+	for i, queued := range s.queue {
+		if queued.event.Message.Object.Path == msg.Object.Path {
+			s.sequence++
+			s.queue[i] = queuedEvent{
+				sequence: s.sequence,
+				event:    Event{Message: msg, Dropped: queued.event.Dropped}}
+			s.dropped++
+			return true
+		}
+	}
+	return false
+}
+
+/*
+forward hands the oldest buffered event to the channel until the subscription is
+closed. The event stays buffered until it has been received, so it can still be
+dropped or replaced meanwhile, in which case the new oldest event is handed over
+instead.
+*/
+func (s *Subscription) forward() {
+	defer close(s.stopped)
+	for {
+		s.mutex.Lock()
+		if len(s.queue) == 0 {
+			s.mutex.Unlock()
+			select {
+			case <-s.changed:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		head := s.queue[0]
+		s.mutex.Unlock()
+		select {
+		case s.events <- head.event:
+			s.mutex.Lock()
+			// if it was dropped or replaced just while being received it is already gone
+			if len(s.queue) > 0 && s.queue[0].sequence == head.sequence {
+				s.queue = s.queue[1:]
+			}
+			s.mutex.Unlock()
+		case <-s.changed:
+			// the oldest event may have changed, so look again
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package model
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+historyDir is the directory within LOCALDIR that keeps previous contents of files
+by identification, see Model.HistoryLimit.
+*/
+const historyDir = "history"
+
+/*
+historySuffix marks content held in the temp directory for the history.
+*/
+const historySuffix = ".hist"
+
+/*
+HistoryEntry is a previous content of a file kept in the history.
+*/
+type HistoryEntry struct {
+	Version shared.Version
+	Content string
+	Size    int64
+	Saved   time.Time
+}
+
+/*
+History returns the previous contents kept for the file at path, oldest first.
+*/
+func (m *Model) History(path *shared.RelativePath) ([]HistoryEntry, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	stin, exists := m.StaticInfos[path.SubPath()]
+	if !exists {
+		return nil, shared.ErrUntracked
+	}
+	return m.readHistory(stin.Identification)
+}
+
+/*
+Restore replaces the file at path with the content kept in the history for the
+given version. The change is applied as a local modify, so it is sent to all
+peers with a new version.
+*/
+func (m *Model) Restore(path *shared.RelativePath, version shared.Version) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.wrapApply("restore", path, nil, m.restore(path, version))
+}
+
+/*
+restore is Restore without locking.
+*/
+func (m *Model) restore(path *shared.RelativePath, version shared.Version) error {
+	stin, exists := m.StaticInfos[path.SubPath()]
+	if !exists {
+		return shared.ErrUntracked
+	}
+	if stin.Directory {
+		return shared.ErrIllegalParameters
+	}
+	base := m.historyPath(stin.Identification) + "/" + versionKey(version)
+	data, err := ioutil.ReadFile(base + ".json")
+	if err != nil {
+		return ErrNoHistory
+	}
+	var entry HistoryEntry
+	err = json.Unmarshal(data, &entry)
+	if err != nil {
+		return err
+	}
+	// nothing to do if already the current content
+	if entry.Content == stin.Content && !m.isModified(path, nil) {
+		return nil
+	}
+	// keep the current content so that the restore can be undone
+	held := m.holdHistory(path)
+	// copy first so that the file is replaced atomically
+	temppath := m.RootPath + "/" + shared.TINZENITEDIR + "/" + shared.TEMPDIR + "/" + stin.Identification + tempSuffix
+	err = copyFile(base, temppath)
+	if err == nil {
+		// the kept content may have been damaged since it was saved
+		var hash string
+		hash, err = shared.ContentHash(temppath)
+		if err == nil && hash != entry.Content {
+			err = ErrHistoryCorrupt
+		}
+	}
+	if err == nil {
+		err = os.Rename(temppath, path.FullPath())
+	}
+	if err != nil {
+		os.Remove(temppath)
+		m.releaseHistory(held)
+		return err
+	}
+	m.saveHistory(held)
+	err = m.applyModify(path, nil, nil)
+	if err != nil {
+		return err
+	}
+	return m.persist()
+}
+
+/*
+heldVersion is the content of a file that is about to be overwritten, held in
+the temp directory until the overwrite has succeeded.
+*/
+type heldVersion struct {
+	path     *shared.RelativePath
+	stin     staticinfo
+	temppath string
+}
+
+/*
+holdHistory keeps the current content of the file at path aside if the history
+is enabled, returning nil otherwise. The file is linked instead of copied, which
+is safe as long as the file is then replaced by a rename: the held content stays
+untouched. It must be passed to saveHistory once the file has been replaced, or
+to releaseHistory if that failed, as the link then still points at the tracked
+file. Directories have no content and are never held. Failures are only logged
+as they must never stop the operation that overwrites the file.
+*/
+func (m *Model) holdHistory(path *shared.RelativePath) *heldVersion {
+	if m.HistoryLimit <= 0 {
+		return nil
+	}
+	stin, exists := m.StaticInfos[path.SubPath()]
+	if !exists || stin.Directory {
+		return nil
+	}
+	held := &heldVersion{
+		path:     path,
+		stin:     stin,
+		temppath: m.RootPath + "/" + shared.TINZENITEDIR + "/" + shared.TEMPDIR + "/" + stin.Identification + historySuffix}
+	os.Remove(held.temppath)
+	err := os.Link(path.FullPath(), held.temppath)
+	if err != nil {
+		// not all file systems support links
+		err = copyFile(path.FullPath(), held.temppath)
+	}
+	if err != nil {
+		os.Remove(held.temppath)
+		m.warn("History: failed to hold previous content!", Fields{Path: path.SubPath(), Identification: stin.Identification, Operation: "history", Err: err})
+		return nil
+	}
+	return held
+}
+
+/*
+releaseHistory drops the held content because the file wasn't replaced after
+all. Does nothing for nil.
+*/
+func (m *Model) releaseHistory(held *heldVersion) {
+	if held != nil {
+		os.Remove(held.temppath)
+	}
+}
+
+/*
+saveHistory moves the held content into the history once the file has been
+replaced. Does nothing for nil. Failures are only logged, see holdHistory.
+*/
+func (m *Model) saveHistory(held *heldVersion) {
+	if held == nil {
+		return
+	}
+	err := m.saveVersion(held)
+	if err != nil {
+		os.Remove(held.temppath)
+		m.warn("History: failed to save previous content!", Fields{Path: held.path.SubPath(), Identification: held.stin.Identification, Operation: "history", Err: err})
+	}
+}
+
+/*
+saveVersion moves the held content into the history under its version and drops
+the oldest entries beyond the limit.
+*/
+func (m *Model) saveVersion(held *heldVersion) error {
+	stin := held.stin
+	dir := m.historyPath(stin.Identification)
+	err := os.MkdirAll(dir, shared.FILEPERMISSIONMODE)
+	if err != nil {
+		return err
+	}
+	stat, err := os.Lstat(held.temppath)
+	if err != nil {
+		return err
+	}
+	// the file may have changed since the last update, only then it must be hashed
+	content := stin.Content
+	if stat.Size() != stin.Size || !stat.ModTime().Equal(stin.Modtime) {
+		content, err = shared.ContentHash(held.temppath)
+		if err != nil {
+			return err
+		}
+	}
+	base := dir + "/" + versionKey(stin.Version)
+	err = os.Rename(held.temppath, base)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(HistoryEntry{
+		Version: stin.Version,
+		Content: content,
+		Size:    stat.Size(),
+		Saved:   time.Now()})
+	if err != nil {
+		return err
+	}
+	err = writeSynced(base+".json", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, data)
+	if err != nil {
+		return err
+	}
+	return m.pruneHistory(stin.Identification)
+}
+
+/*
+pruneHistory removes the oldest entries of the identification beyond the limit.
+*/
+func (m *Model) pruneHistory(identification string) error {
+	entries, err := m.readHistory(identification)
+	if err != nil {
+		return err
+	}
+	for len(entries) > m.HistoryLimit {
+		base := m.historyPath(identification) + "/" + versionKey(entries[0].Version)
+		// metadata first so that the entry is never listed without content
+		err = os.Remove(base + ".json")
+		if err != nil {
+			return err
+		}
+		os.Remove(base)
+		entries = entries[1:]
+	}
+	return nil
+}
+
+/*
+readHistory returns all history entries of the identification, oldest first.
+*/
+func (m *Model) readHistory(identification string) ([]HistoryEntry, error) {
+	dir := m.historyPath(identification)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var entries []HistoryEntry
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(dir + "/" + file.Name())
+		if err != nil {
+			return nil, err
+		}
+		var entry HistoryEntry
+		err = json.Unmarshal(data, &entry)
+		if err != nil {
+			m.warn("History: ignoring corrupt entry!", Fields{Path: file.Name(), Identification: identification, Operation: "history", Err: err})
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Saved.Before(entries[j].Saved)
+	})
+	return entries, nil
+}
+
+/*
+historyPath returns the directory of the history of the identification.
+*/
+func (m *Model) historyPath(identification string) string {
+	return m.RootPath + "/" + shared.TINZENITEDIR + "/" + shared.LOCALDIR + "/" + historyDir + "/" + identification
+}
+
+/*
+versionKey returns a file name unique for the version.
+*/
+func versionKey(version shared.Version) string {
+	var parts []string
+	for peer, count := range version {
+		parts = append(parts, peer+"-"+strconv.Itoa(count))
+	}
+	if len(parts) == 0 {
+		return "0"
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "_")
+}
+
+/*
+copyFile copies the content of the file at from to the file at to and flushes it
+to disk.
+*/
+func copyFile(from, to string) error {
+	source, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	target, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, shared.FILEPERMISSIONMODE)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(target, source)
+	if err == nil {
+		err = target.Sync()
+	}
+	closeErr := target.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
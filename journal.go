@@ -0,0 +1,251 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strconv"
+)
+
+/*
+Every change to the model is recorded in a journal next to the stored model so
+that applying a change doesn't require writing the complete model. Once the
+journal holds more than journalLimit records it is compacted by storing the
+complete model again. Each record carries a sequence number; the stored model
+remembers the last one it includes so that records are never replayed twice.
+Records also carry the generation of the stored model they continue, so that a
+journal is never replayed onto a different one, for example the backup.
+*/
+const (
+	journalFile  = "model.journal"
+	journalLimit = 10000
+)
+
+/*
+Operations of journal records.
+*/
+const (
+	journalSet      = "set"
+	journalDelete   = "del"
+	journalConflict = "conflict"
+)
+
+/*
+journalRecord is a single change of the model. For journalSet the object is
+tracked with the given staticinfo, for journalDelete it is removed. For
+journalConflict the conflict of the path is set, or removed if Conflict is nil.
+*/
+type journalRecord struct {
+	Sequence   int64       `json:"seq"`
+	Generation int64       `json:"gen"`
+	Op         string      `json:"op"`
+	Path       string      `json:"path"`
+	Object     *staticinfo `json:"object,omitempty"`
+	Conflict   *Conflict   `json:"conflict,omitempty"`
+}
+
+/*
+setObject tracks the object at the sub path with the given staticinfo. All
+changes to tracked objects must be made via setObject and removeObject so that
+they are journaled.
+*/
+func (m *Model) setObject(subpath string, stin staticinfo) {
+	ids := m.identifications()
+	// the identification of an object may change (see Bootstrap)
+	if old, exists := m.StaticInfos[subpath]; exists && ids[old.Identification] == subpath {
+		delete(ids, old.Identification)
+	}
+	m.TrackedPaths[subpath] = true
+	m.StaticInfos[subpath] = stin
+	ids[stin.Identification] = subpath
+	m.record(journalRecord{Op: journalSet, Path: subpath, Object: &stin})
+}
+
+/*
+removeObject removes the object at the sub path from the model.
+*/
+func (m *Model) removeObject(subpath string) {
+	ids := m.identifications()
+	if stin, exists := m.StaticInfos[subpath]; exists && ids[stin.Identification] == subpath {
+		delete(ids, stin.Identification)
+	}
+	delete(m.TrackedPaths, subpath)
+	delete(m.StaticInfos, subpath)
+	m.record(journalRecord{Op: journalDelete, Path: subpath})
+}
+
+/*
+identifications returns the index of the sub path of each object by its
+identification. The index is kept up to date by setObject and removeObject, so
+reading it never modifies the model.
+*/
+func (m *Model) identifications() map[string]string {
+	return m.ids
+}
+
+/*
+indexIdentifications builds the index of identifications from scratch. Must be
+called whenever StaticInfos are changed without setObject and removeObject.
+*/
+func (m *Model) indexIdentifications() {
+	m.ids = make(map[string]string, len(m.StaticInfos))
+	for subpath, stin := range m.StaticInfos {
+		m.ids[stin.Identification] = subpath
+	}
+}
+
+/*
+setConflict adds the conflict to the registry, replacing any older conflict of
+the same path.
+*/
+func (m *Model) setConflict(conflict Conflict) {
+	// may be nil for models loaded from older versions
+	if m.Conflicts == nil {
+		m.Conflicts = make(map[string]Conflict)
+	}
+	m.Conflicts[conflict.Path] = conflict
+	m.record(journalRecord{Op: journalConflict, Path: conflict.Path, Conflict: &conflict})
+}
+
+/*
+removeConflict removes the conflict of the sub path from the registry.
+*/
+func (m *Model) removeConflict(subpath string) {
+	delete(m.Conflicts, subpath)
+	m.record(journalRecord{Op: journalConflict, Path: subpath})
+}
+
+/*
+record adds the change to the records that will be written on the next persist.
+The record is encoded immediately as the staticinfo may be changed afterwards.
+*/
+func (m *Model) record(record journalRecord) {
+	m.Sequence++
+	record.Sequence = m.Sequence
+	record.Generation = m.Generation
+	data, err := json.Marshal(record)
+	if err != nil {
+		// can't happen for our types, but the next Store will include the change anyway
+		m.error("Journal: failed to encode record!", Fields{Path: record.Path, Operation: record.Op, Err: err})
+		return
+	}
+	m.pending = append(m.pending, data)
+}
+
+/*
+persist writes all pending changes to disk. Usually they are appended to the
+journal, but if the model hasn't been stored yet or the journal has grown too
+large the complete model is stored instead.
+*/
+func (m *Model) persist() error {
+	if !m.stored || m.journaled+len(m.pending) > journalLimit {
+		return m.store()
+	}
+	if len(m.pending) == 0 {
+		return nil
+	}
+	var buffer bytes.Buffer
+	for _, data := range m.pending {
+		buffer.Write(data)
+		buffer.WriteByte('\n')
+	}
+	err := m.getStorage().Append(journalFile, buffer.Bytes())
+	if err != nil {
+		// part of the records may have been written, so appending again would
+		// follow a broken record that ends the replay; store the complete model instead
+		m.stored = false
+		return err
+	}
+	m.journaled += len(m.pending)
+	m.pending = nil
+	return nil
+}
+
+/*
+compacted is called once the complete model has been stored. The journal is then
+no longer required.
+*/
+func (m *Model) compacted() error {
+	m.stored = true
+	m.pending = nil
+	m.journaled = 0
+	err := m.getStorage().Remove(journalFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+/*
+replayJournal applies all records of the journal that the model doesn't include
+yet. A truncated last record (from a crash while appending) is cut off so that
+further records can be appended cleanly. Records of another generation are
+discarded: they continue a model that couldn't be loaded, so applying them would
+skip all changes between the loaded model and that one.
+*/
+func (m *Model) replayJournal() error {
+	storage := m.getStorage()
+	data, err := storage.Read(journalFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// the index is rebuilt once all records are applied
+	defer m.indexIdentifications()
+	valid := 0
+	discarded := 0
+	for valid < len(data) {
+		end := bytes.IndexByte(data[valid:], '\n')
+		var record journalRecord
+		// a record without newline was never completely written
+		if end < 0 || json.Unmarshal(data[valid:valid+end], &record) != nil {
+			m.warn("Journal: truncated, ignoring the rest!", Fields{Operation: "replay"})
+			return storage.Write(journalFile, data[:valid])
+		}
+		valid += end + 1
+		m.journaled++
+		if record.Generation != m.Generation {
+			discarded++
+			continue
+		}
+		if record.Sequence <= m.Sequence {
+			continue
+		}
+		m.replay(record)
+		m.Sequence = record.Sequence
+	}
+	if discarded != 0 {
+		m.warn("Journal: discarded "+strconv.Itoa(discarded)+" records of another generation!", Fields{Operation: "replay"})
+	}
+	return nil
+}
+
+/*
+replay applies a single journal record to the model.
+*/
+func (m *Model) replay(record journalRecord) {
+	switch record.Op {
+	case journalSet:
+		if record.Object == nil {
+			return
+		}
+		m.TrackedPaths[record.Path] = true
+		m.StaticInfos[record.Path] = *record.Object
+	case journalDelete:
+		delete(m.TrackedPaths, record.Path)
+		delete(m.StaticInfos, record.Path)
+	case journalConflict:
+		if m.Conflicts == nil {
+			m.Conflicts = make(map[string]Conflict)
+		}
+		if record.Conflict == nil {
+			delete(m.Conflicts, record.Path)
+		} else {
+			m.Conflicts[record.Path] = *record.Conflict
+		}
+	default:
+		m.warn("Journal: unknown operation!", Fields{Path: record.Path, Operation: record.Op})
+	}
+}
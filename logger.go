@@ -0,0 +1,157 @@
+package model
+
+import (
+	"log"
+	"strings"
+)
+
+/*
+LogLevel is the severity of a log message.
+*/
+type LogLevel int
+
+/*
+Possible log levels, from least to most severe.
+*/
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+/*
+Fields are the structured values of a log message. Empty values are omitted.
+*/
+type Fields struct {
+	Path           string
+	Identification string
+	Operation      string
+	Peer           string
+	Err            error
+}
+
+/*
+Logger receives all log messages of the model, see Model.SetLogger.
+*/
+type Logger interface {
+	Debug(msg string, fields Fields)
+	Info(msg string, fields Fields)
+	Warn(msg string, fields Fields)
+	Error(msg string, fields Fields)
+}
+
+/*
+stdLogger writes to a logger of the standard library.
+*/
+type stdLogger struct {
+	logger *log.Logger
+	level  LogLevel
+}
+
+/*
+NewStdLogger returns a Logger writing all messages of at least the given level to
+the standard library logger. If logger is nil the default logger is used. This is
+the default logger of the model, logging from LogInfo.
+*/
+func NewStdLogger(logger *log.Logger, level LogLevel) Logger {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &stdLogger{logger: logger, level: level}
+}
+
+func (s *stdLogger) Debug(msg string, fields Fields) { s.print(LogDebug, "DEBUG:", msg, fields) }
+func (s *stdLogger) Info(msg string, fields Fields)  { s.print(LogInfo, "", msg, fields) }
+func (s *stdLogger) Warn(msg string, fields Fields)  { s.print(LogWarn, "WARNING:", msg, fields) }
+func (s *stdLogger) Error(msg string, fields Fields) { s.print(LogError, "ERROR:", msg, fields) }
+
+/*
+print writes the message if the level is enabled.
+*/
+func (s *stdLogger) print(level LogLevel, prefix, msg string, fields Fields) {
+	if level < s.level {
+		return
+	}
+	toPrint := []string{tag}
+	if prefix != "" {
+		toPrint = append(toPrint, prefix)
+	}
+	toPrint = append(toPrint, msg)
+	add := func(key, value string) {
+		if value != "" {
+			toPrint = append(toPrint, key+"="+value)
+		}
+	}
+	add("path", fields.Path)
+	add("id", fields.Identification)
+	add("op", fields.Operation)
+	add("peer", fields.Peer)
+	if fields.Err != nil {
+		add("error", fields.Err.Error())
+	}
+	s.logger.Println(strings.Join(toPrint, " "))
+}
+
+/*
+discardLogger drops all messages.
+*/
+type discardLogger struct{}
+
+func (discardLogger) Debug(msg string, fields Fields) {}
+func (discardLogger) Info(msg string, fields Fields)  {}
+func (discardLogger) Warn(msg string, fields Fields)  {}
+func (discardLogger) Error(msg string, fields Fields) {}
+
+/*
+SetLogger sets the logger all messages of the model are written to. A nil logger
+silences the model completely.
+*/
+func (m *Model) SetLogger(logger Logger) {
+	if logger == nil {
+		logger = discardLogger{}
+	}
+	m.logMutex.Lock()
+	defer m.logMutex.Unlock()
+	m.logger = logger
+}
+
+/*
+getLogger returns the logger of the model, defaulting to the standard library.
+*/
+func (m *Model) getLogger() Logger {
+	m.logMutex.Lock()
+	defer m.logMutex.Unlock()
+	if m.logger == nil {
+		m.logger = NewStdLogger(nil, LogInfo)
+	}
+	return m.logger
+}
+
+/*
+debug logs a message only useful when debugging.
+*/
+func (m *Model) debug(msg string, fields Fields) {
+	m.getLogger().Debug(msg, fields)
+}
+
+/*
+info logs a message about normal operation.
+*/
+func (m *Model) info(msg string, fields Fields) {
+	m.getLogger().Info(msg, fields)
+}
+
+/*
+warn logs a message about something unexpected that the model can handle.
+*/
+func (m *Model) warn(msg string, fields Fields) {
+	m.getLogger().Warn(msg, fields)
+}
+
+/*
+error logs a message about a failed operation.
+*/
+func (m *Model) error(msg string, fields Fields) {
+	m.getLogger().Error(msg, fields)
+}
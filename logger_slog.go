@@ -0,0 +1,52 @@
+//go:build go1.21
+
+package model
+
+import (
+	"context"
+	"log/slog"
+)
+
+/*
+slogLogger writes to a structured logger.
+*/
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+/*
+NewSlogLogger returns a Logger writing to the slog logger, passing all fields as
+attributes. If logger is nil the default logger is used. Requires Go 1.21, older
+versions only have NewStdLogger.
+*/
+func NewSlogLogger(logger *slog.Logger) Logger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &slogLogger{logger: logger}
+}
+
+func (s *slogLogger) Debug(msg string, fields Fields) { s.log(slog.LevelDebug, msg, fields) }
+func (s *slogLogger) Info(msg string, fields Fields)  { s.log(slog.LevelInfo, msg, fields) }
+func (s *slogLogger) Warn(msg string, fields Fields)  { s.log(slog.LevelWarn, msg, fields) }
+func (s *slogLogger) Error(msg string, fields Fields) { s.log(slog.LevelError, msg, fields) }
+
+/*
+log writes the message with all non empty fields as attributes.
+*/
+func (s *slogLogger) log(level slog.Level, msg string, fields Fields) {
+	var attrs []slog.Attr
+	add := func(key, value string) {
+		if value != "" {
+			attrs = append(attrs, slog.String(key, value))
+		}
+	}
+	add("path", fields.Path)
+	add("id", fields.Identification)
+	add("op", fields.Operation)
+	add("peer", fields.Peer)
+	if fields.Err != nil {
+		add("error", fields.Err.Error())
+	}
+	s.logger.LogAttrs(context.Background(), level, msg, attrs...)
+}
@@ -0,0 +1,25 @@
+//go:build go1.21
+
+package model
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/tinzenite/shared"
+)
+
+func TestModel_SetSlogLogger(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	model, _ := Create(root, PEERID, root+"/"+shared.STOREMODELDIR)
+	var buffer bytes.Buffer
+	// slog receives the fields as attributes
+	model.SetLogger(NewSlogLogger(slog.New(slog.NewTextHandler(&buffer, &slog.HandlerOptions{Level: slog.LevelDebug}))))
+	_, _ = model.GetInfo(shared.CreatePath(root, "missing"))
+	if line := buffer.String(); !strings.Contains(line, "level=DEBUG") || !strings.Contains(line, "path=missing") {
+		t.Error("Expected debug message with path, got", line)
+	}
+}
@@ -1,8 +1,6 @@
 package model
 
 import (
-	"encoding/json"
-	"io/ioutil"
 	"sort"
 
 	"github.com/tinzenite/shared"
@@ -20,28 +18,56 @@ func Create(root string, peerid string, storePath string) (*Model, error) {
 		return nil, shared.ErrNotTinzenite
 	}
 	m := &Model{
+		Schema:       modelSchema,
 		RootPath:     root,
 		TrackedPaths: make(map[string]bool),
 		StaticInfos:  make(map[string]staticinfo),
+		Conflicts:    make(map[string]Conflict),
 		SelfID:       peerid,
 		StorePath:    storePath}
+	m.indexIdentifications()
 	return m, nil
 }
 
 /*
-LoadFrom the given path a model.
+LoadFrom the given path a model. See LoadFromStorage.
 */
 func LoadFrom(path string) (*Model, error) {
 	if path == "" {
 		return nil, shared.ErrIllegalParameters
 	}
+	return LoadFromStorage(NewFileStorage(path))
+}
+
+/*
+LoadFromStorage loads a model from the given storage, which is then also used to
+store the model. If the stored model is corrupt the backup of the previous Store
+is loaded instead. Changes journaled since are replayed. Models of older versions
+are migrated, models of newer versions return ErrIncompatibleModel.
+*/
+func LoadFromStorage(storage Storage) (*Model, error) {
+	if storage == nil {
+		return nil, shared.ErrIllegalParameters
+	}
 	var m *Model
-	data, err := ioutil.ReadFile(path + "/" + shared.MODELJSON)
+	// falls back to the previous generation if the model is corrupt
+	fromBackup, err := readFallback(storage, shared.MODELJSON, func(data []byte) error {
+		loaded, err := decodeModel(data)
+		if err != nil {
+			return err
+		}
+		m = loaded
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	// load as json
-	err = json.Unmarshal(data, &m)
+	m.storage = storage
+	m.stored = true
+	m.fromBackup = fromBackup
+	m.indexIdentifications()
+	// apply all changes made since the model was stored
+	err = m.replayJournal()
 	if err != nil {
 		return nil, err
 	}
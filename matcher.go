@@ -3,19 +3,62 @@ package model
 import (
 	"io/ioutil"
 	"os"
+	pathpkg "path"
 	"strings"
+	"time"
 
 	"github.com/tinzenite/shared"
 )
 
 /*
-Matcher is a helper object that checks paths against a .tinignore file.
+Matcher is a helper object that checks paths against a .tinignore file. The
+rules follow the gitignore pattern language: "*", "?", and "[...]" classes match
+within a path element, "**" matches any number of elements, "!" negates a rule,
+a trailing "/" only matches directories, and a rule containing a "/" is anchored
+to the directory of the .tinignore file. For backwards compatibility a plain name
+without any special characters also matches files ending with it. Rules of all
+parent .tinignore files apply too, with deeper files overriding their parents.
 */
 type Matcher struct {
-	root      string
-	dirRules  []string
-	fileRules []string
-	used      bool
+	root       string
+	rules      []rule
+	used       bool
+	parent     *Matcher
+	ignoreFile fileState
+	cache      map[string]*cachedMatcher
+	generation int
+}
+
+/*
+cachedMatcher is the resolved matcher of a directory, together with what it was
+built from so that it can be validated cheaply.
+*/
+type cachedMatcher struct {
+	matcher    *Matcher
+	parent     *Matcher
+	ignoreFile fileState
+	generation int
+}
+
+/*
+fileState describes a .tinignore file on disk. If it changes, the file must be
+read again.
+*/
+type fileState struct {
+	exists  bool
+	size    int64
+	modtime time.Time
+}
+
+/*
+rule is a single parsed line of a .tinignore file.
+*/
+type rule struct {
+	segments  []string
+	negate    bool
+	directory bool
+	anchored  bool
+	legacy    bool
 }
 
 /*
@@ -26,6 +69,7 @@ in.
 func CreateMatcher(rootPath string) (*Matcher, error) {
 	var match Matcher
 	match.root = rootPath
+	match.ignoreFile = tinIgnoreState(rootPath)
 	allRules, err := readTinIgnore(rootPath)
 	if err == shared.ErrNoTinIgnore {
 		// if empty we're done
@@ -35,15 +79,15 @@ func CreateMatcher(rootPath string) (*Matcher, error) {
 		return nil, err
 	}
 	for _, line := range allRules {
-		// is the line a rule for a directory?
-		if strings.HasPrefix(line, "/") {
-			match.dirRules = append(match.dirRules, line)
-		} else {
-			match.fileRules = append(match.fileRules, line)
+		parsed, ok := parseRule(line)
+		if !ok {
+			// illegal patterns are ignored
+			continue
 		}
+		match.rules = append(match.rules, parsed)
 	}
 	// possibly empty .tinignore so catch
-	if len(match.dirRules) != 0 || len(match.fileRules) != 0 {
+	if len(match.rules) != 0 {
 		// if we have values set it
 		match.used = true
 	}
@@ -52,43 +96,84 @@ func CreateMatcher(rootPath string) (*Matcher, error) {
 
 /*
 Ignore checks whether the given path is to be ignored given the rules within the
-root .tinignore file.
+.tinignore files of the matcher and its parents. A path within an ignored
+directory is always ignored.
 */
 func (m *Matcher) Ignore(path string) bool {
 	// no need to check anything in this case
 	if m.IsEmpty() {
 		return false
 	}
-	// start with directories as we always need to check these
-	for _, dirLine := range m.dirRules {
-		// contains because may be subdir already
-		if strings.Contains(path, dirLine) {
-			return true
+	chain := m.chain()
+	top := chain[0].root
+	// only paths beneath the root can match
+	if !strings.HasPrefix(path, top+"/") {
+		return false
+	}
+	segments := strings.Split(strings.TrimPrefix(path, top+"/"), "/")
+	// depth at which the rules of each matcher start to apply
+	depths := make([]int, len(chain))
+	for i, matcher := range chain {
+		if matcher.root != top {
+			depths[i] = len(strings.Split(strings.TrimPrefix(matcher.root, top+"/"), "/"))
 		}
 	}
-	// make sure the path IS a file (no need to check anything otherwise)
-	info, err := os.Lstat(path)
-	if err != nil {
-		return false
+	// directory only rules need to know what the path is (removed objects count as files)
+	isDir := false
+	if info, err := os.Lstat(path); err == nil {
+		isDir = info.IsDir()
 	}
-	// no need to check file stuff if path points to directory
-	if !info.IsDir() {
-		// check files
-		for _, fileLine := range m.fileRules {
-			// suffix because rest of path doesn't matter for file matches
-			if strings.HasSuffix(path, fileLine) {
-				return true
+	// the path is ignored if it or any parent is ignored
+	for i := 1; i <= len(segments); i++ {
+		ignored := false
+		// deeper matchers come later and so override their parents
+		for j, matcher := range chain {
+			if depths[j] >= i {
+				continue
+			}
+			if matched, ignore := matcher.evaluate(segments[depths[j]:i], i < len(segments) || isDir); matched {
+				ignored = ignore
 			}
 		}
+		if ignored {
+			return true
+		}
 	}
 	return false
 }
 
 /*
-IsEmpty can be used to see if the matcher contains any rules at all.
+evaluate all own rules for the path elements relative to the matcher root.
+Returns whether any rule matched and if so whether the last one ignores the path.
+*/
+func (m *Matcher) evaluate(segments []string, isDir bool) (bool, bool) {
+	matched, ignored := false, false
+	for _, rule := range m.rules {
+		if rule.matches(segments, isDir) {
+			matched = true
+			ignored = !rule.negate
+		}
+	}
+	return matched, ignored
+}
+
+/*
+chain returns the matcher and all its parents, starting with the topmost one.
+*/
+func (m *Matcher) chain() []*Matcher {
+	var chain []*Matcher
+	for current := m; current != nil; current = current.parent {
+		chain = append([]*Matcher{current}, chain...)
+	}
+	return chain
+}
+
+/*
+IsEmpty can be used to see if the matcher or its parents contain any rules at
+all.
 */
 func (m *Matcher) IsEmpty() bool {
-	return !m.used
+	return !m.used && (m.parent == nil || m.parent.IsEmpty())
 }
 
 /*
@@ -99,21 +184,76 @@ func (m *Matcher) Same(path string) bool {
 }
 
 /*
-Resolve the matcher for the given path from the bottom up. If no matcher is found
-on any subpath, the original matcher is returned.
+Resolve the matcher for the given path. The resolved matcher contains the rules of
+all .tinignore files from the root down to the directory containing the path. If
+no further .tinignore exists, the original matcher is returned. Must be called on
+the root matcher. Resolved matchers are cached, see Refresh.
 */
 func (m *Matcher) Resolve(path *shared.RelativePath) *Matcher {
-	// !path.AtRoot ensures that we stop if we reach the root path
-	for hasTinIgnore(path.FullPath()) != true && !path.AtRoot() {
-		path = path.Up()
-	}
-	matcher, err := CreateMatcher(path.FullPath())
-	if err != nil {
+	// the rules of a directory apply to its contents, so start with the parent
+	if path.AtRoot() {
 		return m
 	}
-	if matcher.Same(m.root) {
+	return m.resolveDirectory(path.Up())
+}
+
+/*
+Refresh starts a new generation of the cache: each cached directory is validated
+against its .tinignore once more on its next use. Returns false if the root
+.tinignore itself changed, in which case a new matcher must be created.
+*/
+func (m *Matcher) Refresh() bool {
+	if tinIgnoreState(m.root) != m.ignoreFile {
+		return false
+	}
+	// forget directories that weren't used in the last generation (may be gone)
+	for dir, cached := range m.cache {
+		if cached.generation < m.generation {
+			delete(m.cache, dir)
+		}
+	}
+	m.generation++
+	return true
+}
+
+/*
+resolveDirectory returns the matcher for the contents of the directory. It is
+computed only once per directory and then shared by all children. Within one
+generation the cache is trusted, otherwise the .tinignore is checked for changes
+and only read again if it did.
+*/
+func (m *Matcher) resolveDirectory(dir *shared.RelativePath) *Matcher {
+	if dir.AtRoot() || m.Same(dir.FullPath()) {
 		return m
 	}
+	if m.cache == nil {
+		m.cache = make(map[string]*cachedMatcher)
+	}
+	cached, exists := m.cache[dir.FullPath()]
+	if exists && cached.generation == m.generation {
+		return cached.matcher
+	}
+	parent := m.resolveDirectory(dir.Up())
+	state := tinIgnoreState(dir.FullPath())
+	// still valid if neither the parent nor the .tinignore changed
+	if exists && cached.parent == parent && cached.ignoreFile == state {
+		cached.generation = m.generation
+		return cached.matcher
+	}
+	matcher := parent
+	if state.exists {
+		child, err := CreateMatcher(dir.FullPath())
+		// empty .tinignore files change nothing, so reuse the parent then
+		if err == nil && child.used {
+			child.parent = parent
+			matcher = child
+		}
+	}
+	m.cache[dir.FullPath()] = &cachedMatcher{
+		matcher:    matcher,
+		parent:     parent,
+		ignoreFile: state,
+		generation: m.generation}
 	return matcher
 }
 
@@ -121,6 +261,102 @@ func (m *Matcher) String() string {
 	return "Matcher of <" + m.root + ">"
 }
 
+/*
+refreshMatcher returns the given root matcher ready for a new walk, or a new one
+if there is none yet or the root .tinignore changed.
+*/
+func refreshMatcher(master *Matcher, root string) (*Matcher, error) {
+	if master != nil && master.root == root && master.Refresh() {
+		return master, nil
+	}
+	return CreateMatcher(root)
+}
+
+/*
+parseRule parses a single line of a .tinignore file. Returns false if the line
+is not a legal pattern.
+*/
+func parseRule(line string) (rule, bool) {
+	var parsed rule
+	line = strings.TrimRight(line, " \t\r")
+	if strings.HasPrefix(line, "!") {
+		parsed.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		// escaped special characters at the start
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		parsed.directory = true
+		line = strings.TrimRight(line, "/")
+	}
+	// any slash left anchors the rule to the root
+	parsed.anchored = strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return parsed, false
+	}
+	// gitignore negates classes with "!", path.Match with "^"
+	line = strings.Replace(line, "[!", "[^", -1)
+	parsed.segments = strings.Split(line, "/")
+	for _, segment := range parsed.segments {
+		if _, err := pathpkg.Match(segment, ""); err != nil {
+			return parsed, false
+		}
+	}
+	parsed.legacy = !parsed.anchored && !parsed.negate && !parsed.directory &&
+		!strings.ContainsAny(line, "*?[\\")
+	return parsed, true
+}
+
+/*
+matches returns true if the rule matches the path elements.
+*/
+func (r *rule) matches(segments []string, isDir bool) bool {
+	if r.directory && !isDir {
+		return false
+	}
+	if r.anchored {
+		return matchSegments(r.segments, segments)
+	}
+	// not anchored rules match the name on any level
+	name := segments[len(segments)-1]
+	if ok, _ := pathpkg.Match(r.segments[0], name); ok {
+		return true
+	}
+	// the old syntax matched files by suffix
+	return r.legacy && !isDir && strings.HasSuffix(name, r.segments[0])
+}
+
+/*
+matchSegments matches pattern elements against path elements, where "**" matches
+any number of elements.
+*/
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		// a trailing "**" only matches what is inside, not the directory itself
+		if len(pattern) == 1 {
+			return len(segments) > 0
+		}
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if ok, _ := pathpkg.Match(pattern[0], segments[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], segments[1:])
+}
+
 /*
 ReadTinIgnore reads the .tinignore file in the given path if it exists. If not
 or some other error happens it returns ErrNoTinIgnore.
@@ -150,9 +386,15 @@ func readTinIgnore(path string) ([]string, error) {
 }
 
 /*
-hasTinIgnore checks whether the path has a .tinignore file.
+tinIgnoreState returns the state of the .tinignore file in the path.
 */
-func hasTinIgnore(path string) bool {
-	_, err := ioutil.ReadFile(path + "/" + shared.TINIGNORE)
-	return err == nil
+func tinIgnoreState(path string) fileState {
+	stat, err := os.Lstat(path + "/" + shared.TINIGNORE)
+	if err != nil {
+		return fileState{}
+	}
+	return fileState{
+		exists:  true,
+		size:    stat.Size(),
+		modtime: stat.ModTime()}
 }
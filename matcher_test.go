@@ -0,0 +1,128 @@
+package model
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+func TestMatcher_Ignore(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	rules := []string{
+		"/build",
+		"*.tmp",
+		"!keep.tmp",
+		"cache/",
+		"docs/**/draft?.md",
+		"[!a]x.bin",
+		".log",
+	}
+	_ = ioutil.WriteFile(root+"/"+shared.TINIGNORE, []byte(strings.Join(rules, "\n")), shared.FILEPERMISSIONMODE)
+	// directories must exist for directory only rules
+	os.MkdirAll(root+"/src/cache", shared.FILEPERMISSIONMODE)
+	os.MkdirAll(root+"/src/build", shared.FILEPERMISSIONMODE)
+	matcher, err := CreateMatcher(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]bool{
+		"build":                  true,
+		"build/x":                true,
+		"src/build":              false,
+		"src/rebuild/x":          false,
+		"a.tmp":                  true,
+		"src/b.tmp":              true,
+		"keep.tmp":               false,
+		"src/cache":              true,
+		"src/cache/file":         true,
+		"cache":                  false,
+		"docs/draft1.md":         true,
+		"docs/a/b/draft2.md":     true,
+		"docs/a/draft10.md":      false,
+		"bx.bin":                 true,
+		"ax.bin":                 false,
+		"server.log":             true,
+		"src/.log":               true,
+		"src/catalog":            false,
+		"src/keep.tmp/something": false,
+	}
+	for subpath, ignore := range expected {
+		if matcher.Ignore(root+"/"+subpath) != ignore {
+			t.Error("Expected Ignore of", subpath, "to be", ignore)
+		}
+	}
+}
+
+func TestMatcher_Resolve(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	os.MkdirAll(root+"/sub/deeper", shared.FILEPERMISSIONMODE)
+	_ = ioutil.WriteFile(root+"/"+shared.TINIGNORE, []byte("*.tmp\n/sub/deeper/excluded\n"), shared.FILEPERMISSIONMODE)
+	_ = ioutil.WriteFile(root+"/sub/"+shared.TINIGNORE, []byte("!keep.tmp\n*.log\n"), shared.FILEPERMISSIONMODE)
+	master, err := CreateMatcher(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relPath := shared.CreatePathRoot(root)
+	expected := map[string]bool{
+		"keep.tmp":               true,
+		"a.log":                  false,
+		"sub/keep.tmp":           false,
+		"sub/other.tmp":          true,
+		"sub/a.log":              true,
+		"sub/deeper/b.log":       true,
+		"sub/deeper/keep.tmp":    false,
+		"sub/deeper/excluded":    true,
+		"sub/deeper/notexcluded": false,
+	}
+	for subpath, ignore := range expected {
+		path := relPath.Apply(root + "/" + subpath)
+		if master.Resolve(path).Ignore(path.FullPath()) != ignore {
+			t.Error("Expected Ignore of", subpath, "to be", ignore)
+		}
+	}
+	// children of the same directory must share the matcher
+	if master.Resolve(relPath.Apply(root+"/sub/x")) != master.Resolve(relPath.Apply(root+"/sub/y")) {
+		t.Error("Expected matcher to be shared")
+	}
+}
+
+func TestMatcher_Refresh(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	os.MkdirAll(root+"/sub", shared.FILEPERMISSIONMODE)
+	_ = ioutil.WriteFile(root+"/sub/"+shared.TINIGNORE, []byte("*.log\n"), shared.FILEPERMISSIONMODE)
+	master, err := CreateMatcher(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := shared.CreatePathRoot(root).Apply(root + "/sub/a.log")
+	cached := master.Resolve(path)
+	if !cached.Ignore(path.FullPath()) {
+		t.Error("Expected a.log to be ignored")
+	}
+	// unchanged files must keep the cached matcher
+	if !master.Refresh() || master.Resolve(path) != cached {
+		t.Error("Expected cached matcher to be reused")
+	}
+	// changed files must be read again
+	_ = ioutil.WriteFile(root+"/sub/"+shared.TINIGNORE, []byte("*.txt\n"), shared.FILEPERMISSIONMODE)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(root+"/sub/"+shared.TINIGNORE, future, future)
+	if !master.Refresh() {
+		t.Error("Expected root matcher to remain valid")
+	}
+	if master.Resolve(path).Ignore(path.FullPath()) {
+		t.Error("Expected a.log to no longer be ignored")
+	}
+	// a changed root .tinignore requires a new matcher
+	_ = ioutil.WriteFile(root+"/"+shared.TINIGNORE, []byte("*.tmp\n"), shared.FILEPERMISSIONMODE)
+	if master.Refresh() {
+		t.Error("Expected root matcher to be invalid")
+	}
+}
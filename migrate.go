@@ -0,0 +1,193 @@
+package model
+
+import (
+	"encoding/json"
+	"os"
+)
+
+/*
+modelSchema is the current layout version of the stored model. It must be
+increased whenever the layout changes, together with a migration upgrading the
+previous layout. This includes new fields whose migration only sets the value
+that decoding gives anyway: older builds would otherwise load the model and drop
+the field on their next store. The price is that they can't load it at all.
+*/
+const modelSchema = 7
+
+/*
+migration upgrades the raw stored model by exactly one schema version.
+*/
+type migration func(raw map[string]interface{}) error
+
+/*
+migrations holds all known migrations, the migration at index i upgrading a model
+of schema i to schema i+1. Migrations work on the raw JSON so that they aren't
+affected by later changes to the structs.
+*/
+var migrations = []migration{
+	migrateSizes,
+	migrateModes,
+	migrateConflicts,
+	migrateChunking,
+	migrateSequence,
+	migrateGeneration,
+	migrateHistory,
+}
+
+/*
+decodeModel decodes the stored model, migrating it step by step from the schema
+it was written with to the current one.
+*/
+func decodeModel(data []byte) (*Model, error) {
+	var raw map[string]interface{}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return nil, ErrModelCorrupt
+	}
+	// models written before versioning have no schema
+	schema := 0
+	if value, exists := raw["Schema"]; exists {
+		number, ok := value.(float64)
+		if !ok {
+			return nil, ErrModelCorrupt
+		}
+		schema = int(number)
+	}
+	if schema > modelSchema {
+		return nil, ErrIncompatibleModel
+	}
+	for ; schema < modelSchema; schema++ {
+		err = migrations[schema](raw)
+		if err != nil {
+			return nil, err
+		}
+	}
+	raw["Schema"] = modelSchema
+	data, err = json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var m *Model
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+/*
+migrateSizes upgrades schema 0 to 1: the size of files is read from disk, as it
+wasn't stored before.
+*/
+func migrateSizes(raw map[string]interface{}) error {
+	root, _ := raw["RootPath"].(string)
+	stins, _ := raw["StaticInfos"].(map[string]interface{})
+	for subpath, value := range stins {
+		stin, ok := value.(map[string]interface{})
+		if !ok {
+			return ErrModelCorrupt
+		}
+		if directory, _ := stin["Directory"].(bool); directory {
+			continue
+		}
+		stat, err := os.Lstat(root + "/" + subpath)
+		if err != nil {
+			// will be detected as removed on the next update anyway
+			continue
+		}
+		stin["Size"] = stat.Size()
+	}
+	return nil
+}
+
+/*
+migrateModes upgrades schema 1 to 2: the permissions of directories are read
+from disk, as they weren't stored before.
+*/
+func migrateModes(raw map[string]interface{}) error {
+	root, _ := raw["RootPath"].(string)
+	stins, _ := raw["StaticInfos"].(map[string]interface{})
+	for subpath, value := range stins {
+		stin, ok := value.(map[string]interface{})
+		if !ok {
+			return ErrModelCorrupt
+		}
+		if directory, _ := stin["Directory"].(bool); !directory {
+			continue
+		}
+		// a stored mode may differ from the disk because of a change not yet applied
+		if mode, _ := stin["Mode"].(float64); mode != 0 {
+			continue
+		}
+		stat, err := os.Lstat(root + "/" + subpath)
+		if err != nil {
+			// will be detected as removed on the next update anyway
+			continue
+		}
+		stin["Mode"] = stat.Mode().Perm()
+	}
+	return nil
+}
+
+/*
+migrateConflicts upgrades schema 2 to 3: the conflict registry is added. Conflict
+copies of older versions always held the remote version, which is the default of
+CopyLocal.
+*/
+func migrateConflicts(raw map[string]interface{}) error {
+	conflicts, exists := raw["Conflicts"]
+	if !exists || conflicts == nil {
+		raw["Conflicts"] = map[string]interface{}{}
+		return nil
+	}
+	if _, ok := conflicts.(map[string]interface{}); !ok {
+		return ErrModelCorrupt
+	}
+	return nil
+}
+
+/*
+migrateChunking upgrades schema 3 to 4: chunking is added, disabled by default.
+Without chunking no block lists are stored, they are computed when required.
+*/
+func migrateChunking(raw map[string]interface{}) error {
+	return setDefault(raw, "Chunking", false)
+}
+
+/*
+migrateSequence upgrades schema 4 to 5: the journal sequence is added. Older
+versions wrote no journal, so it starts at zero.
+*/
+func migrateSequence(raw map[string]interface{}) error {
+	return setDefault(raw, "Sequence", 0)
+}
+
+/*
+migrateGeneration upgrades schema 5 to 6: the generation of the stored model is
+added. Journals of older versions carry no generation, so it starts at zero to
+match them.
+*/
+func migrateGeneration(raw map[string]interface{}) error {
+	return setDefault(raw, "Generation", 0)
+}
+
+/*
+migrateHistory upgrades schema 6 to 7: the history limit is added. History is
+opt-in, so it is disabled.
+*/
+func migrateHistory(raw map[string]interface{}) error {
+	return setDefault(raw, "HistoryLimit", 0)
+}
+
+/*
+setDefault sets the value of key if it isn't stored yet.
+*/
+func setDefault(raw map[string]interface{}, key string, value interface{}) error {
+	if _, exists := raw[key]; !exists {
+		raw[key] = value
+	}
+	return nil
+}
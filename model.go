@@ -1,45 +1,128 @@
 package model
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/tinzenite/shared"
 )
 
 /*
-Model of a directory and its contents.
+Model of a directory and its contents. If Chunking is set, files additionally
+store their content defined block lists so that transfers can be limited to the
+blocks that actually changed. Schema is the layout version of the stored model,
+see migrations. Sequence is the number of the last change, see journal. If
+HistoryLimit is set, up to that many previous contents of each file are kept
+before remote changes overwrite or remove them, see History.
+
+All methods are safe for concurrent use: reads run in parallel while changes are
+serialized. Exported methods lock and then call their unexported counterparts,
+which must be used internally instead. The exported fields must not be accessed
+directly while the model is in use.
 */
 type Model struct {
+	Schema       int
 	RootPath     string
 	StorePath    string
 	SelfID       string
+	Chunking     bool
+	HistoryLimit int
 	TrackedPaths map[string]bool
 	StaticInfos  map[string]staticinfo
-	updatechan   chan shared.UpdateMessage
+	Conflicts    map[string]Conflict
+	Sequence     int64
+	Generation   int64
+	bus          *eventBus
+	busOnce      sync.Once
+	registered   *Subscription
+	matcher      *Matcher
+	storage      Storage
+	ids          map[string]string
+	mutex        sync.RWMutex
+	scanning     sync.Mutex
+	hashWorkers  int
+	pending      [][]byte
+	journaled    int
+	stored       bool
+	fromBackup   bool
+	logger       Logger
+	logMutex     sync.Mutex
 }
 
 /*
 Update the complete model state.
 */
 func (m *Model) Update() error {
-	return m.PartialUpdate(m.RootPath)
+	return m.UpdateContext(context.Background())
+}
+
+/*
+UpdateContext updates the complete model state unless the context is canceled,
+see PartialUpdateContext.
+*/
+func (m *Model) UpdateContext(ctx context.Context) error {
+	return m.PartialUpdateContext(ctx, m.RootPath)
 }
 
 /*
 PartialUpdate of the model state. Scope is the the FULL path of the scope in
-absolute terms!
+absolute terms! The directory is walked and all changed files are hashed before
+the model is locked, so other calls are only blocked while the changes are
+applied.
 */
 func (m *Model) PartialUpdate(scope string) error {
+	return m.PartialUpdateContext(context.Background(), scope)
+}
+
+/*
+PartialUpdateContext is PartialUpdate, but stops as soon as the context is
+canceled, returning ctx.Err(). Changes applied until then are kept, so the model
+is always consistent; the remaining ones are picked up by the next update.
+*/
+func (m *Model) PartialUpdateContext(ctx context.Context, scope string) error {
+	current, err := m.scan(ctx, scope)
+	if err != nil {
+		return err
+	}
+	prepared, err := m.prepareDigests(ctx, current)
+	if err != nil {
+		return err
+	}
+	return m.update(ctx, scope, current, prepared, nil)
+}
+
+/*
+update locks the model and applies the scan result of the scope using the
+prepared digests. If an expected plan is given nothing is applied unless the
+changes still match it.
+*/
+func (m *Model) update(ctx context.Context, scope string, current map[string]bool, prepared digests, expected *Plan) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	// the model may have changed since, but the digests are only used where still valid
+	if expected != nil {
+		planned, err := m.plan(scope, current, prepared)
+		if err != nil {
+			return err
+		}
+		if !planned.matches(expected) {
+			return ErrPlanOutdated
+		}
+	}
 	// update local model
-	err := m.updateLocal(scope)
+	err := m.applyUpdate(ctx, scope, current, prepared)
 	if err != nil {
+		if ctx.Err() != nil {
+			// keep what has been applied so far
+			m.persist()
+		}
 		return err
 	}
 	// ensure that removes are handled
@@ -47,8 +130,8 @@ func (m *Model) PartialUpdate(scope string) error {
 	if err != nil {
 		return err
 	}
-	// finally also store the model for future loads.
-	return m.Store()
+	// finally also persist the changes for future loads.
+	return m.persist()
 }
 
 /*
@@ -59,12 +142,20 @@ must still be applied!
 NOTE: Will not check and enforce that the models are compatible!
 */
 func (m *Model) Sync(root *shared.ObjectInfo) ([]*shared.UpdateMessage, error) {
+	if root == nil {
+		return nil, wrapError("sync", "", "", shared.ErrIllegalParameters)
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 	// we'll need the simple lists of the foreign model for both cases
 	foreignPaths := make(map[string]bool)
 	foreignObjs := make(map[string]*shared.ObjectInfo)
+	foreignIDs := make(map[string]string)
 	root.ForEach(func(obj shared.ObjectInfo) {
 		// write to paths
 		foreignPaths[obj.Path] = true
+		// remember where each object lives to detect moves
+		foreignIDs[obj.Identification] = obj.Path
 		// strip of children and write to objects
 		obj.Objects = nil
 		foreignObjs[obj.Path] = &obj
@@ -77,11 +168,17 @@ func (m *Model) Sync(root *shared.ObjectInfo) ([]*shared.UpdateMessage, error) {
 	for _, subpath := range created {
 		remObj, exists := foreignObjs[subpath]
 		if !exists {
-			m.warn("Created path", subpath, "doesn't exist in remote model!")
+			m.warn("Sync: created path doesn't exist in remote model!", Fields{Path: subpath, Operation: "sync"})
 			continue
 		}
 		// check if object has been locally removed --> we ignore it then
-		if m.IsRemoved(remObj.Identification) {
+		if m.isRemoved(remObj.Identification) {
+			continue
+		}
+		// if we know the object under another path it has been moved, which is sent as modify of the new path
+		if m.isMoved(remObj) {
+			um := shared.CreateUpdateMessage(shared.OpModify, *remObj)
+			umList = append(umList, &um)
 			continue
 		}
 		um := shared.CreateUpdateMessage(shared.OpCreate, *remObj)
@@ -89,35 +186,32 @@ func (m *Model) Sync(root *shared.ObjectInfo) ([]*shared.UpdateMessage, error) {
 	}
 	// for all modified paths...
 	for _, subpath := range modified {
-		localObj, err := m.GetInfo(shared.CreatePath(m.RootPath, subpath))
+		localObj, err := m.getInfo(shared.CreatePath(m.RootPath, subpath))
 		if err != nil {
-			m.log("SyncModel: failed to fetch local obj for modify check!")
+			m.warn("Sync: failed to fetch local obj for modify check!", Fields{Path: subpath, Operation: "sync", Err: err})
 			continue
 		}
 		remObj, exists := foreignObjs[subpath]
 		if !exists {
-			m.warn("SyncModel: Modified path", subpath, "doesn't exist in remote model!")
+			m.warn("Sync: modified path doesn't exist in remote model!", Fields{Path: subpath, Operation: "sync"})
 			continue
 		}
 		// if remObj knows of an update we don't --> get it as modify
 		if !localObj.Version.Includes(remObj.Version) {
 			// NOTE: the above can NOT be equal --> that was a BUG
-			// make sure we're not allowing directories to be modified
-			if localObj.Directory {
-				// shouldn't happen but catch to be sure
-				m.warn("SyncModel: Found modified directory?!")
-				// ignore!
-				continue
-			}
 			um := shared.CreateUpdateMessage(shared.OpModify, *remObj)
 			umList = append(umList, &um)
 		}
 	}
 	// for all removed paths...
 	for _, subpath := range removed {
-		localObj, err := m.GetInfo(shared.CreatePath(m.RootPath, subpath))
+		localObj, err := m.getInfo(shared.CreatePath(m.RootPath, subpath))
 		if err != nil {
-			m.log("SyncModel: failed to fetch local obj for remove check!")
+			m.warn("Sync: failed to fetch local obj for remove check!", Fields{Path: subpath, Operation: "sync", Err: err})
+			continue
+		}
+		// if the foreign model has the object under another path it was moved (handled above)
+		if _, moved := foreignIDs[localObj.Identification]; moved {
 			continue
 		}
 		// to detect if the object has been deleted, check if the the removedir exists for it
@@ -142,11 +236,16 @@ differences can then be synchronized as before via the update messages return by
 this function.
 */
 func (m *Model) Bootstrap(root *shared.ObjectInfo) ([]*shared.UpdateMessage, error) {
+	if root == nil {
+		return nil, wrapError("bootstrap", "", "", shared.ErrIllegalParameters)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	/*TODO for now just warn, should work though... :P */
-	if !m.IsEmpty() {
-		m.warn("bootstrap: non empty bootstrap!")
+	if !m.isEmpty() {
+		m.warn("Bootstrap: non empty bootstrap!", Fields{Operation: "bootstrap"})
 	}
-	m.log("Bootstrapping from remote model.")
+	m.info("Bootstrapping from remote model.", Fields{Operation: "bootstrap"})
 	// we'll need the simple lists of the foreign model
 	foreignObjs := make(map[string]*shared.ObjectInfo)
 	root.ForEach(func(obj shared.ObjectInfo) {
@@ -173,19 +272,19 @@ func (m *Model) Bootstrap(root *shared.ObjectInfo) ([]*shared.UpdateMessage, err
 		localstin, exists := m.StaticInfos[remoteSubpath]
 		if !exists {
 			// shouldn't happen but just in case...
-			m.log("bootstrap:", "local model tracked and stin not in sync!")
-			return nil, shared.ErrIllegalFileState
+			m.error("Bootstrap: local model tracked and stin not in sync!", Fields{Path: remoteSubpath, Operation: "bootstrap"})
+			return nil, wrapError("bootstrap", remoteSubpath, remoteObj.Identification, shared.ErrIllegalFileState)
 		}
 		// assign other ID always (otherwise cummulative merge won't work)
 		localstin.Identification = remoteObj.Identification
 		// assign version
 		localstin.Version = remoteObj.Version
 		// set to local model
-		m.StaticInfos[remoteSubpath] = localstin
+		m.setObject(remoteSubpath, localstin)
 		// if content not same, add update message as modify to bring both version to same content
-		if localstin.Content != remoteObj.Content {
+		if localstin.content() != remoteObj.Content {
 			// this will overwrite the local file! but here we want this behaviour, so all ok
-			m.log("bootstrap: force updating <" + remoteSubpath + ">.")
+			m.info("Bootstrap: force updating.", Fields{Path: remoteSubpath, Identification: remoteObj.Identification, Operation: "bootstrap"})
 			um := shared.CreateUpdateMessage(shared.OpModify, *remoteObj)
 			umList = append(umList, &um)
 		}
@@ -200,6 +299,15 @@ HasUpdate checks whether the update has already been applied locally. Used to
 avoid getting updates that originated from us.
 */
 func (m *Model) HasUpdate(um *shared.UpdateMessage) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.hasUpdate(um)
+}
+
+/*
+hasUpdate is HasUpdate without locking.
+*/
+func (m *Model) hasUpdate(um *shared.UpdateMessage) bool {
 	// get local version
 	stin, exists := m.StaticInfos[um.Object.Path]
 	// depends on operation!
@@ -214,7 +322,7 @@ func (m *Model) HasUpdate(um *shared.UpdateMessage) bool {
 		// if the object already exists we have it
 		return exists
 	default:
-		m.warn("HasUpdate checking unknown operation!")
+		m.warn("HasUpdate: checking unknown operation!", Fields{Path: um.Object.Path, Identification: um.Object.Identification, Operation: um.Operation.String()})
 		return false
 	}
 }
@@ -226,32 +334,42 @@ NOTE: Usually model.CheckMessage should be called and handled before calling
 this method!
 */
 func (m *Model) ApplyUpdateMessage(msg *shared.UpdateMessage) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	var err error
 	path := shared.CreatePath(m.RootPath, msg.Object.Path)
 	switch msg.Operation {
 	case shared.OpCreate:
-		err = m.ApplyCreate(path, &msg.Object)
+		err = m.applyCreate(path, &msg.Object, nil)
 	case shared.OpModify:
-		err = m.ApplyModify(path, &msg.Object)
+		err = m.applyModify(path, &msg.Object, nil)
 	case shared.OpRemove:
-		err = m.ApplyRemove(path, &msg.Object)
+		err = m.applyRemove(path, &msg.Object)
 	default:
-		m.log("Unknown operation in UpdateMessage:", msg.Operation.String())
-		return shared.ErrUnsupported
+		m.warn("ApplyUpdateMessage: unknown operation!", Fields{Path: msg.Object.Path, Identification: msg.Object.Identification, Operation: msg.Operation.String()})
+		err = shared.ErrUnsupported
 	}
-	if err != nil {
-		return err
+	if err == nil {
+		// persist updates to disk
+		err = m.persist()
+	} else if err == shared.ErrConflict {
+		// keep the registered conflict
+		m.persist()
 	}
-	// store updates to disk
-	return m.Store()
+	return m.wrapApply(operationName(msg.Operation), path, &msg.Object, err)
 }
 
 /*
 Register the channel over which UpdateMessage can be received. Tinzenite will
-only ever write to this channel, never read.
+only ever write to this channel, never read. Messages are written while the model
+is locked, so the channel must be read independently of calls to the model. This
+is a blocking subscription to all events replacing any previously registered
+channel, see Subscribe for more options.
 */
 func (m *Model) Register(v chan shared.UpdateMessage) {
-	m.updatechan = v
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.register(v)
 }
 
 /*
@@ -260,13 +378,15 @@ depth. Incredibly fast because we only link objects based on the current state
 of the model: hashes etc are not recalculated.
 */
 func (m *Model) Read() (*shared.ObjectInfo, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 	var allObjs shared.Sortable
 	rpath := shared.CreatePathRoot(m.RootPath)
 	// getting all Objectinfos is very fast because the staticinfo already exists for all of them
 	for fullpath := range m.TrackedPaths {
-		obj, err := m.GetInfo(rpath.Apply(fullpath))
+		obj, err := m.getInfo(rpath.Apply(fullpath))
 		if err != nil {
-			log.Println(err.Error())
+			m.warn("Read: failed to get info!", Fields{Path: fullpath, Err: err})
 			continue
 		}
 		allObjs = append(allObjs, obj)
@@ -276,29 +396,91 @@ func (m *Model) Read() (*shared.ObjectInfo, error) {
 	// build the tree!
 	root := allObjs[0]
 	/*build tree recursively*/
-	m.FillInfo(root, allObjs)
+	m.fillInfo(root, allObjs)
 	return root, nil
 }
 
 /*
-Store the model to disk in the correct directory.
+Store the model to its storage, by default the StorePath on disk. The write is
+atomic and the previous model is kept as backup, see LoadFrom. As the complete
+model is written the journal is cleared.
 */
 func (m *Model) Store() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.store()
+}
+
+/*
+store is Store without locking.
+*/
+func (m *Model) store() error {
+	m.Schema = modelSchema
+	// journaled records must not be replayed onto the previous generation
+	m.Generation++
 	jsonBinary, err := json.MarshalIndent(m, "", "  ")
 	if err != nil {
+		m.Generation--
+		return err
+	}
+	storage := m.getStorage()
+	// keep the previous generation, unless it is corrupt: the backup is then the only good one
+	if !m.fromBackup {
+		err = storage.Rename(shared.MODELJSON, shared.MODELJSON+backupSuffix)
+		if err != nil && !os.IsNotExist(err) {
+			m.Generation--
+			return err
+		}
+	}
+	err = storage.Write(shared.MODELJSON, jsonBinary)
+	if err != nil {
+		m.Generation--
 		return err
 	}
-	return ioutil.WriteFile(m.StorePath+"/"+shared.MODELJSON, jsonBinary, shared.FILEPERMISSIONMODE)
+	m.fromBackup = false
+	return m.compacted()
+}
+
+/*
+SetStorage sets the storage the model is persisted to. The complete model is
+written to it on the next change or Store.
+*/
+func (m *Model) SetStorage(storage Storage) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if storage == nil {
+		return shared.ErrIllegalParameters
+	}
+	m.storage = storage
+	m.stored = false
+	return nil
+}
+
+/*
+getStorage returns the storage of the model, defaulting to the StorePath.
+*/
+func (m *Model) getStorage() Storage {
+	if m.storage == nil {
+		m.storage = NewFileStorage(m.StorePath)
+	}
+	return m.storage
 }
 
 /*
 GetSubPath returns the sub path of whatever object satisfies the identification.
 */
 func (m *Model) GetSubPath(identification string) (string, error) {
-	for path, stin := range m.StaticInfos {
-		if stin.Identification == identification {
-			return path, nil
-		}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.getSubPath(identification)
+}
+
+/*
+getSubPath is GetSubPath without locking.
+*/
+func (m *Model) getSubPath(identification string) (string, error) {
+	if path, exists := m.identifications()[identification]; exists {
+		return path, nil
 	}
 	return "", errors.New("corresponding file for id <" + identification + "> not found")
 }
@@ -307,6 +489,8 @@ func (m *Model) GetSubPath(identification string) (string, error) {
 GetIdentification returns the ID of an object at the given path.
 */
 func (m *Model) GetIdentification(path *shared.RelativePath) (string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 	stin, ok := m.StaticInfos[path.SubPath()]
 	if !ok {
 		return "", shared.ErrUntracked
@@ -318,11 +502,13 @@ func (m *Model) GetIdentification(path *shared.RelativePath) (string, error) {
 GetInfoFrom takes an identification and returns the corresponding shared.ObjectInfo.
 */
 func (m *Model) GetInfoFrom(identification string) (*shared.ObjectInfo, error) {
-	subpath, err := m.GetSubPath(identification)
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	subpath, err := m.getSubPath(identification)
 	if err != nil {
 		return nil, err
 	}
-	return m.GetInfo(shared.CreatePath(m.RootPath, subpath))
+	return m.getInfo(shared.CreatePath(m.RootPath, subpath))
 }
 
 /*
@@ -330,15 +516,24 @@ GetInfo creates the Objectinfo for the given path, so long as the path is
 contained in m.Tracked. Directories are NOT traversed!
 */
 func (m *Model) GetInfo(path *shared.RelativePath) (*shared.ObjectInfo, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.getInfo(path)
+}
+
+/*
+getInfo is GetInfo without locking.
+*/
+func (m *Model) getInfo(path *shared.RelativePath) (*shared.ObjectInfo, error) {
 	_, exists := m.TrackedPaths[path.SubPath()]
 	if !exists {
-		m.log("GetInfo: path not tracked!", path.SubPath())
+		m.debug("GetInfo: path not tracked!", Fields{Path: path.SubPath()})
 		return nil, shared.ErrUntracked
 	}
 	// get staticinfo
 	stin, exists := m.StaticInfos[path.SubPath()]
 	if !exists {
-		m.log("GetInfo: stin not tracked!", path.SubPath())
+		m.warn("GetInfo: stin not tracked!", Fields{Path: path.SubPath()})
 		return nil, shared.ErrUntracked
 	}
 	stat, err := os.Lstat(path.FullPath())
@@ -352,13 +547,8 @@ func (m *Model) GetInfo(path *shared.RelativePath) (*shared.ObjectInfo, error) {
 		Path:           path.SubPath(),
 		Shadow:         false,
 		Version:        stin.Version}
-	if stat.IsDir() {
-		object.Directory = true
-		object.Content = ""
-	} else {
-		object.Directory = false
-		object.Content = stin.Content
-	}
+	object.Directory = stat.IsDir()
+	object.Content = stin.content()
 	return object, nil
 }
 
@@ -367,6 +557,15 @@ FillInfo takes an Objectinfo and a list of candidates and recursively fills its
 Object's slice. If root is a file it simply returns root.
 */
 func (m *Model) FillInfo(root *shared.ObjectInfo, all []*shared.ObjectInfo) *shared.ObjectInfo {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.fillInfo(root, all)
+}
+
+/*
+fillInfo is FillInfo without locking.
+*/
+func (m *Model) fillInfo(root *shared.ObjectInfo, all []*shared.ObjectInfo) *shared.ObjectInfo {
 	if !root.Directory {
 		// this may be an error, check later
 		return root
@@ -387,7 +586,7 @@ func (m *Model) FillInfo(root *shared.ObjectInfo, all []*shared.ObjectInfo) *sha
 			continue
 		}
 		// if reached the object is in our subdir, so add and recursively fill
-		root.Objects = append(root.Objects, m.FillInfo(obj, all))
+		root.Objects = append(root.Objects, m.fillInfo(obj, all))
 	}
 	return root
 }
@@ -396,6 +595,15 @@ func (m *Model) FillInfo(root *shared.ObjectInfo, all []*shared.ObjectInfo) *sha
 IsEmpty returns true if the model is empty SAVE for the .tinzenite files.
 */
 func (m *Model) IsEmpty() bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.isEmpty()
+}
+
+/*
+isEmpty is IsEmpty without locking.
+*/
+func (m *Model) isEmpty() bool {
 	// basically if model has any files apart from those in the .tinzenite dir, it is not empty
 	for subpath := range m.TrackedPaths {
 		// root path is ignored
@@ -418,6 +626,15 @@ func (m *Model) IsEmpty() bool {
 IsTracked returns true if the given path is tracked by this model.
 */
 func (m *Model) IsTracked(path string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.isTracked(path)
+}
+
+/*
+isTracked is IsTracked without locking.
+*/
+func (m *Model) isTracked(path string) bool {
 	relPath := shared.CreatePathRoot(m.RootPath).Apply(path)
 	_, pathExists := m.TrackedPaths[relPath.SubPath()]
 	_, stinExists := m.StaticInfos[relPath.SubPath()]
@@ -432,30 +649,56 @@ TODO: rewrite note... ErrObjectRemovalDone
 TODO: Will always return updated updateMessage (although may be unmodified if not
 necessary.)
 
-NOTE: The method returns two errors that should be checked for and handled by
-the caller specifically: ErrUpdateKnown and ErrObjectRemoved. The first signals
-the caller to discard the message because the update has already been previously
-applied to the model. The second means that the caller should resend the removal
-message as the update is for a removed object.
+NOTE: The method returns two errors that should be checked for with errors.Is
+and handled by the caller specifically: ErrIgnoreUpdate and ErrObjectRemoved.
+The first signals the caller to discard the message because the update has
+already been previously applied to the model. The second means that the caller
+should resend the removal message as the update is for a removed object. All
+errors are of type *Error.
 */
 func (m *Model) CheckMessage(um *shared.UpdateMessage) (*shared.UpdateMessage, error) {
+	original := *um
+	m.mutex.RLock()
+	um, err := m.checkMessage(um)
+	m.mutex.RUnlock()
+	if err == shared.ErrConflict {
+		// registering requires the write lock, and the model may change before we get it
+		m.mutex.Lock()
+		*um = original
+		um, err = m.checkMessage(um)
+		if err == shared.ErrConflict {
+			m.recordConflict(shared.CreatePath(m.RootPath, um.Object.Path), &um.Object)
+			m.persist()
+		}
+		m.mutex.Unlock()
+	}
+	if err != nil {
+		return um, wrapError(operationName(um.Operation), um.Object.Path, um.Object.Identification, err)
+	}
+	return um, nil
+}
+
+/*
+checkMessage is CheckMessage without locking and without wrapping the errors.
+*/
+func (m *Model) checkMessage(um *shared.UpdateMessage) (*shared.UpdateMessage, error) {
 	// check if the update is already known --> if yes we don't want to reapply it
-	if m.HasUpdate(um) {
+	if m.hasUpdate(um) {
 		return um, ErrIgnoreUpdate
 	}
-	// check if modify for unknown object --> make message a create operation
-	if !m.IsTracked(um.Object.Path) && um.Operation == shared.OpModify {
+	// check if modify for unknown object --> make message a create operation (moves are modifies of known objects)
+	if !m.isTracked(um.Object.Path) && um.Operation == shared.OpModify && !m.isMoved(&um.Object) {
 		// this can happen for example if a transfer has not yet completed and we
 		// already received a modify
 		um.Operation = shared.OpCreate
 	}
 	// check if create for known object --> make message a modify operation
-	if m.IsTracked(um.Object.Path) && um.Operation == shared.OpCreate {
+	if m.isTracked(um.Object.Path) && um.Operation == shared.OpCreate {
 		// note that this may well cause a merge, which is the desired behaviour
 		um.Operation = shared.OpModify
 	}
 	// check if removed --> if yes warn and ignore update (except if a remove operation)
-	if m.IsRemoved(um.Object.Identification) && um.Operation != shared.OpRemove {
+	if m.isRemoved(um.Object.Identification) && um.Operation != shared.OpRemove {
 		// return ErrObjectRemoved to notify that message sender must be notified of removal
 		return um, ErrObjectRemoved
 	}
@@ -465,10 +708,9 @@ func (m *Model) CheckMessage(um *shared.UpdateMessage) (*shared.UpdateMessage, e
 		// if not a create operation, something is wrong
 		if um.Operation != shared.OpCreate {
 			// this also catches removals WITHIN the REMOVEDIR which shouldn't happen
-			m.warn("Filter ran into disallowed operation!", um.Operation.String())
-			// TODO remove
-			log.Println("DEBUG: disallowed:", um.String())
-			return um, errFilter
+			m.warn("Filter: disallowed operation!", Fields{Path: um.Object.Path, Identification: um.Object.Identification, Operation: um.Operation.String()})
+			m.debug("Filter: disallowed message: "+um.String(), Fields{})
+			return um, ErrFilter
 		}
 		// if parent for removal dir doesn't exist --> ignore
 		if !m.parentsExist(shared.CreatePath(m.RootPath, um.Object.Path)) {
@@ -490,18 +732,22 @@ func (m *Model) CheckMessage(um *shared.UpdateMessage) (*shared.UpdateMessage, e
 	}
 	// ensure parents exists so that operation is not on "hanging" object
 	if !m.parentsExist(shared.CreatePath(m.RootPath, um.Object.Path)) {
-		return um, errParentObjectsMissing
+		return um, ErrParentObjectsMissing
 	}
-	// if not create, object must be tracked
+	// a move must not overwrite another object
+	if um.Operation == shared.OpModify && m.isMoved(&um.Object) && m.isTracked(um.Object.Path) {
+		return um, shared.ErrConflict
+	}
+	// if not create, object must be tracked (or moved)
 	if um.Operation != shared.OpCreate {
-		if !m.IsTracked(um.Object.Path) {
-			return um, errObjectUntracked
+		if !m.isTracked(um.Object.Path) && !m.isMoved(&um.Object) {
+			return um, ErrObjectUntracked
 		}
 	}
 	// check for empty version on modify
 	if um.Operation == shared.OpModify && um.Object.Version.IsEmpty() {
-		m.warn("Filter found empty version on modify!")
-		return um, errFilter
+		m.warn("Filter: empty version on modify!", Fields{Path: um.Object.Path, Identification: um.Object.Identification, Operation: um.Operation.String()})
+		return um, ErrFilter
 	}
 	// if everything okay, return message so that it can be applied
 	return um, nil
@@ -510,9 +756,20 @@ func (m *Model) CheckMessage(um *shared.UpdateMessage) (*shared.UpdateMessage, e
 /*
 ApplyCreate applies a create operation to the local model given that the file
 exists. NOTE: In the case of a file, requires the object to exist in the TEMPDIR
-named as the object indentification.
+named as the object indentification. If a remote file already exists locally the
+remote version is written to a conflict copy instead.
 */
 func (m *Model) ApplyCreate(path *shared.RelativePath, remoteObject *shared.ObjectInfo) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.wrapApply("create", path, remoteObject, m.applyCreate(path, remoteObject, nil))
+}
+
+/*
+applyCreate is ApplyCreate without locking. Local files are hashed using the
+known digests where still valid.
+*/
+func (m *Model) applyCreate(path *shared.RelativePath, remoteObject *shared.ObjectInfo, known digests) error {
 	// NOTE that ApplyCreate does NOT call filterMessage itself!
 	// ensure no file has been written already
 	localExists, err := shared.ObjectExists(path.FullPath())
@@ -520,13 +777,16 @@ func (m *Model) ApplyCreate(path *shared.RelativePath, remoteObject *shared.Obje
 		return err
 	}
 	// sanity check if the object already exists locally
-	if m.IsTracked(path.FullPath()) {
+	if m.isTracked(path.FullPath()) {
 		if localExists {
 			// if tracked and file exists --> merge
+			if remoteObject != nil {
+				return m.applyConflict(path, remoteObject)
+			}
 			return shared.ErrConflict
 		}
 		// if tracked but file doesn't exist --> error
-		m.warn("created object is already tracked but file doesn't exist!")
+		m.warn("Create: object is already tracked but file doesn't exist!", Fields{Path: path.SubPath(), Operation: "create"})
 		return shared.ErrIllegalFileState
 	}
 	// we don't explicitely check m.Objinfo because we'll just overwrite it if already exists
@@ -535,7 +795,7 @@ func (m *Model) ApplyCreate(path *shared.RelativePath, remoteObject *shared.Obje
 	if remoteObject != nil {
 		// create conflict if locally exists
 		if localExists {
-			return shared.ErrConflict
+			return m.applyConflict(path, remoteObject)
 		}
 		// dirs are made directly, files have to be moved from temp
 		if remoteObject.Directory {
@@ -543,15 +803,19 @@ func (m *Model) ApplyCreate(path *shared.RelativePath, remoteObject *shared.Obje
 			if err != nil {
 				return err
 			}
+			err = applyDirectoryContent(path.FullPath(), remoteObject.Content)
+			if err != nil {
+				return err
+			}
 		} else {
 			// apply file op
-			err := m.applyFile(remoteObject.Identification, path.FullPath())
+			err := m.applyFile(remoteObject.Identification, path.FullPath(), path.FullPath(), remoteObject.Content)
 			if err != nil {
 				return err
 			}
 		}
 		// build staticinfo
-		stin, err = createStaticInfo(path.FullPath(), m.SelfID)
+		stin, err = createStaticInfo(path.FullPath(), m.SelfID, m.Chunking, known)
 		if err != nil {
 			return err
 		}
@@ -563,17 +827,16 @@ func (m *Model) ApplyCreate(path *shared.RelativePath, remoteObject *shared.Obje
 			return shared.ErrIllegalFileState
 		}
 		// build staticinfo
-		stin, err = createStaticInfo(path.FullPath(), m.SelfID)
+		stin, err = createStaticInfo(path.FullPath(), m.SelfID, m.Chunking, known)
 		if err != nil {
 			return err
 		}
 	}
 	// add obj to local model
-	m.TrackedPaths[path.SubPath()] = true
-	m.StaticInfos[path.SubPath()] = *stin
-	localObj, err := m.GetInfo(path)
+	m.setObject(path.SubPath(), *stin)
+	localObj, err := m.getInfo(path)
 	if err != nil {
-		m.warn("failed to retrieve created ObjectInfo for notify!")
+		m.warn("Create: failed to retrieve ObjectInfo for notify!", Fields{Path: path.SubPath(), Operation: "create", Err: err})
 	} else {
 		m.notify(shared.OpCreate, localObj)
 	}
@@ -582,72 +845,114 @@ func (m *Model) ApplyCreate(path *shared.RelativePath, remoteObject *shared.Obje
 
 /*
 ApplyModify checks for modifications and if valid applies them to the local model.
-Conflicts will result in deletion of the old file and two creations of both versions
-of the conflict. NOTE: In the case of a file, requires the object to exist in the
-TEMPDIR named as the object indentification.
+Conflicts are resolved the same way on all peers: the winning version is kept at
+the path and the losing one is written to a conflict copy next to it, see
+applyConflict. NOTE: In the case of a file, requires the object to exist in the
+TEMPDIR named as the object indentification. Moves are sent as modifies of the
+new path: a remote object that is locally known under another path is moved to
+the given path, including its subtree. If the content of a moved file is
+unchanged the move is all there is to apply, so no file is required.
 */
 func (m *Model) ApplyModify(path *shared.RelativePath, remoteObject *shared.ObjectInfo) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.wrapApply("modify", path, remoteObject, m.applyModify(path, remoteObject, nil))
+}
+
+/*
+applyModify is ApplyModify without locking. Local files are hashed using the
+known digests where still valid.
+*/
+func (m *Model) applyModify(path *shared.RelativePath, remoteObject *shared.ObjectInfo, known digests) error {
 	// NOTE that ApplyModify does NOT call filterMessage itself!
 	// TODO remove me once this bug is fixed NOTE FIXME WHERE DOES IT COME FROM?!?!
 	if remoteObject != nil && remoteObject.Version.IsEmpty() {
-		log.Println("DEBUG: Yup, ignoring empty version!", remoteObject.Path)
+		m.debug("Modify: ignoring empty version!", Fields{Path: remoteObject.Path, Identification: remoteObject.Identification, Operation: "modify"})
 		// NOTE: doesn't happen from remote apply via chan interface...
 		return nil
 	}
+	// remote objects may have been moved: until all checks passed they stay where they are
+	current := path
+	moved := remoteObject != nil && m.isMoved(remoteObject)
+	if moved {
+		subpath, _ := m.getSubPath(remoteObject.Identification)
+		// never move the root or anything into itself
+		if subpath == "" || strings.HasPrefix(path.SubPath(), subpath+"/") {
+			m.warn("Modify: trying to move illegal path, will ignore!", Fields{Path: subpath, Identification: remoteObject.Identification, Operation: "modify"})
+			return nil
+		}
+		// the target must not exist yet
+		if exists, _ := shared.ObjectExists(path.FullPath()); exists {
+			m.recordConflict(path, remoteObject)
+			return shared.ErrConflict
+		}
+		current = shared.CreatePath(m.RootPath, subpath)
+	}
 	// fetch stin
-	stin, ok := m.StaticInfos[path.SubPath()]
+	stin, ok := m.StaticInfos[current.SubPath()]
 	if !ok {
-		return errModelInconsitent
+		return ErrModelInconsistent
 	}
 	// flag whether the local file has been modified
-	localModified := m.isModified(path)
+	localModified := m.isModified(current, known)
 	// check for remote modifications
 	if remoteObject != nil {
 		/*TODO Check whether modification must even be applied?*/
-		// if remote change the local file may not have been modified
-		if localModified {
-			m.log("Merge error! Untracked local changes!")
-			return shared.ErrConflict
+		// if remote change the local file may not have been modified (directory metadata is never merged)
+		if localModified && !stin.Directory {
+			m.info("Modify: merge error, untracked local changes!", Fields{Path: current.SubPath(), Identification: stin.Identification, Operation: "modify"})
+			return m.applyConflict(current, remoteObject)
 		}
 		// check for merge error
 		if !stin.Version.Valid(remoteObject.Version, m.SelfID) {
-			m.log("Merge error!")
-			return shared.ErrConflict
+			m.info("Modify: merge error!", Fields{Path: current.SubPath(), Identification: stin.Identification, Operation: "modify"})
+			return m.applyConflict(current, remoteObject)
 		}
+		// all checks passed, so only now touch the disk
+		if moved {
+			err := m.moveObject(current, path)
+			if err != nil {
+				return err
+			}
+		}
+		// a pure move has nothing to apply beyond the move itself
+		moveOnly := moved && remoteObject.Content == stin.Content
 		// apply version update
 		stin.Version = remoteObject.Version
-		// if file apply file diff
-		if !remoteObject.Directory {
+		if remoteObject.Directory {
+			// directories only carry their permissions
+			err := applyDirectoryContent(path.FullPath(), remoteObject.Content)
+			if err != nil {
+				return err
+			}
+		} else if !moveOnly {
+			// keep the old content if wanted as it is overwritten now
+			held := m.holdHistory(path)
 			// apply the file op
-			err := m.applyFile(stin.Identification, path.FullPath())
+			err := m.applyFile(stin.Identification, path.FullPath(), path.FullPath(), remoteObject.Content)
 			if err != nil {
+				m.releaseHistory(held)
 				return err
 			}
-		} else {
-			/*TODO can this happen for directories? Only once move is implemented, right?*/
-			m.warn("modify not implemented for directories!")
+			m.saveHistory(held)
 		}
 	} else {
 		if !localModified {
 			// nothing to do, done (shouldn't be called but doesn't harm anything)
-			m.warn("modify should not be called if nothing actually changed!")
+			m.warn("Modify: should not be called if nothing actually changed!", Fields{Path: path.SubPath(), Operation: "modify"})
 			return nil
 		}
 		// update version for local change
 		stin.Version.Increase(m.SelfID)
 	}
 	// update hash and modtime
-	err := stin.updateFromDisk(path.FullPath())
+	err := stin.updateFromDisk(path.FullPath(), m.Chunking, known)
 	if err != nil {
 		return err
 	}
-	// TODO: DEBUG
-	if stin.Directory {
-		log.Println("DEBUG: shouldn't happen: Directory modified!?")
-	}
 	// apply updated
-	m.StaticInfos[path.SubPath()] = stin
-	localObj, _ := m.GetInfo(path)
+	m.setObject(path.SubPath(), stin)
+	localObj, _ := m.getInfo(path)
 	m.notify(shared.OpModify, localObj)
 	return nil
 }
@@ -656,6 +961,15 @@ func (m *Model) ApplyModify(path *shared.RelativePath, remoteObject *shared.Obje
 ApplyRemove applies a remove operation.
 */
 func (m *Model) ApplyRemove(path *shared.RelativePath, remoteObject *shared.ObjectInfo) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.wrapApply("remove", path, remoteObject, m.applyRemove(path, remoteObject))
+}
+
+/*
+applyRemove is ApplyRemove without locking.
+*/
+func (m *Model) applyRemove(path *shared.RelativePath, remoteObject *shared.ObjectInfo) error {
 	// removals within remove dir in ANY case are to be silently ignored
 	if strings.HasPrefix(path.SubPath(), shared.TINZENITEDIR+"/"+shared.REMOVEDIR) {
 		// this is because removals are applied when they are checked (meaning:
@@ -666,7 +980,7 @@ func (m *Model) ApplyRemove(path *shared.RelativePath, remoteObject *shared.Obje
 	remoteRemove := remoteObject != nil
 	// safe guard against unwanted deletions
 	if path.RootPath() != m.RootPath || path.SubPath() == "" {
-		m.warn("ApplyRemove: trying to remove illegal path, will ignore!", path.FullPath())
+		m.warn("Remove: trying to remove illegal path, will ignore!", Fields{Path: path.FullPath(), Operation: "remove"})
 		return nil
 	}
 	// if locally initiated, just apply
@@ -681,43 +995,150 @@ func (m *Model) ApplyRemove(path *shared.RelativePath, remoteObject *shared.Obje
 updateLocal updates the local model for the given scope.
 */
 func (m *Model) updateLocal(scope string) error {
-	if m.TrackedPaths == nil || m.StaticInfos == nil {
-		return shared.ErrNilInternalState
-	}
-	// get current state of model paths
-	current, err := m.populateMap()
+	ctx := context.Background()
+	current, err := m.scan(ctx, scope)
 	if err != nil {
 		return err
 	}
+	return m.applyUpdate(ctx, scope, current, nil)
+}
+
+/*
+scan returns the sub paths of all objects currently within the scope on disk.
+Doesn't access the model, so no lock is required.
+*/
+func (m *Model) scan(ctx context.Context, scope string) (map[string]bool, error) {
+	// get current state of model paths within the scope
+	current, err := m.partialPopulateMap(ctx, scope)
+	if err != nil {
+		return nil, err
+	}
+	// the path to the scope is part of the scope too, so add it if it still exists
+	for path := shared.CreatePathRoot(m.RootPath).Apply(scope); !path.AtRoot(); {
+		path = path.Up()
+		if exists, _ := shared.ObjectExists(path.FullPath()); exists {
+			current[path.SubPath()] = true
+		}
+	}
+	return current, nil
+}
+
+/*
+prepareDigests hashes all files of the scan result that are new or whose modtime
+changed. The model is only read locked to find these, the hashing itself happens
+without any lock and in parallel, see SetHashWorkers. The digests are only used
+once the changes are applied, which happens in sorted order as always.
+*/
+func (m *Model) prepareDigests(ctx context.Context, current map[string]bool) (digests, error) {
+	m.mutex.RLock()
+	if m.TrackedPaths == nil || m.StaticInfos == nil {
+		m.mutex.RUnlock()
+		return nil, shared.ErrNilInternalState
+	}
+	chunked := m.Chunking
+	workers := m.hashWorkers
+	known := make(map[string]time.Time)
+	for subpath := range current {
+		if stin, exists := m.StaticInfos[subpath]; exists {
+			known[subpath] = stin.Modtime
+		}
+	}
+	m.mutex.RUnlock()
+	relPath := shared.CreatePathRoot(m.RootPath)
+	var jobs []hashJob
+	for subpath := range current {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		path := relPath.Apply(subpath).FullPath()
+		stat, err := os.Lstat(path)
+		// may have been removed or is a directory, either way nothing to hash
+		if err != nil || stat.IsDir() {
+			continue
+		}
+		if modtime, exists := known[subpath]; exists && modtime.Equal(stat.ModTime()) {
+			continue
+		}
+		jobs = append(jobs, hashJob{path: path, stat: stat})
+	}
+	return hashFiles(ctx, jobs, workers, chunked)
+}
+
+/*
+SetHashWorkers sets how many files are hashed in parallel during updates. By
+default one worker per CPU is used.
+*/
+func (m *Model) SetHashWorkers(workers int) error {
+	if workers < 1 {
+		return shared.ErrIllegalParameters
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.hashWorkers = workers
+	return nil
+}
+
+/*
+applyUpdate applies all differences between the model and the scan result of
+the scope, using the known digests where still valid. If the context is canceled
+it stops between two objects.
+*/
+func (m *Model) applyUpdate(ctx context.Context, scope string, current map[string]bool, known digests) error {
+	if m.TrackedPaths == nil || m.StaticInfos == nil {
+		return shared.ErrNilInternalState
+	}
 	// now get differences
 	created, modified, removed := m.compareMaps(scope, current)
+	// pair removes and creates that are actually renames or moves
+	var moves []move
+	moves, created, removed = m.detectMoves(created, removed, known)
 	// will need this for every Op so create only once
 	relPath := shared.CreatePathRoot(m.RootPath)
 	// first check creations
 	for _, subpath := range created {
-		err := m.ApplyCreate(relPath.Apply(subpath), nil)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err := m.applyCreate(relPath.Apply(subpath), nil, known)
 		if err != nil {
-			m.log("updateLocal: create error for", subpath)
+			m.error("Update: create failed!", Fields{Path: subpath, Operation: "create", Err: err})
+			return err
+		}
+	}
+	// then moves (after creations so that new parents exist)
+	for _, mv := range moves {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err := m.localMove(relPath.Apply(mv.from), relPath.Apply(mv.to))
+		if err != nil {
+			m.error("Update: move failed!", Fields{Path: mv.from, Operation: "move", Err: err})
 			return err
 		}
 	}
 	// then modifications
 	for _, subpath := range modified {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		modPath := relPath.Apply(subpath)
 		// if no modifications no need to try to apply any
-		if m.isModified(modPath) {
-			err := m.ApplyModify(modPath, nil)
+		if m.isModified(modPath, known) {
+			err := m.applyModify(modPath, nil, known)
 			if err != nil {
-				m.log("updateLocal: modify error for", subpath)
+				m.error("Update: modify failed!", Fields{Path: subpath, Operation: "modify", Err: err})
 				return err
 			}
 		}
 	}
 	// finally deletions
 	for _, subpath := range removed {
-		err := m.ApplyRemove(relPath.Apply(subpath), nil)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err := m.applyRemove(relPath.Apply(subpath), nil)
 		if err != nil {
-			m.log("updateLocal: remove error for", subpath)
+			m.error("Update: remove failed!", Fields{Path: subpath, Operation: "remove", Err: err})
 			return err
 		}
 	}
@@ -736,10 +1157,15 @@ func (m *Model) compareMaps(scope string, current map[string]bool) ([]string, []
 	// prepare slices for changes we're actually interested in
 	var created, modified, removed []string
 	// filter function: returns true if path is neither path to scope or starts with scope.
+	scope = filepath.Clean(scope)
 	skip := func(path string) bool {
+		fullPath := m.RootPath
+		if path != "" {
+			fullPath += "/" + path
+		}
 		// skip if not in partial update path AND not part of path to scope
-		return !strings.HasPrefix(m.RootPath+"/"+path, scope) &&
-			!strings.Contains(scope, m.RootPath+"/"+path)
+		return fullPath != scope && !strings.HasPrefix(fullPath, scope+"/") &&
+			!strings.HasPrefix(scope, fullPath+"/")
 	}
 	// filter out unscoped changes
 	for _, subpath := range tempCreated {
@@ -765,31 +1191,32 @@ func (m *Model) compareMaps(scope string, current map[string]bool) ([]string, []
 }
 
 /*
-isModified checks whether a file has been modified.
+isModified checks whether a file has been modified, using the known digests
+where still valid. Directories are modified if their permissions changed.
 */
-func (m *Model) isModified(path *shared.RelativePath) bool {
+func (m *Model) isModified(path *shared.RelativePath, known digests) bool {
 	stin, ok := m.StaticInfos[path.SubPath()]
 	if !ok {
-		m.log("Staticinfo lookup failed for", path.SubPath(), "!")
-		return false
-	}
-	// no need for further work here
-	if stin.Directory {
+		m.warn("IsModified: staticinfo lookup failed!", Fields{Path: path.SubPath()})
 		return false
 	}
 	// if modtime still the same no need to hash again
 	stat, err := os.Lstat(path.FullPath())
+	// directories only change their permissions (the modtime changes with every child, so ignore it)
+	if stin.Directory {
+		return err == nil && stat.Mode().Perm() != stin.Mode
+	}
 	if err != nil {
-		log.Println(err.Error())
+		m.warn("IsModified: stat failed!", Fields{Path: path.SubPath(), Err: err})
 		// Note that we don't return here because we can still continue without this check
 	} else {
 		if stat.ModTime() == stin.Modtime {
 			return false
 		}
 	}
-	hash, err := shared.ContentHash(path.FullPath())
+	hash, err := known.hash(path.FullPath())
 	if err != nil {
-		log.Println(err.Error())
+		m.warn("IsModified: hashing failed!", Fields{Path: path.SubPath(), Err: err})
 		return false
 	}
 	// if same --> no changes, so done
@@ -800,6 +1227,14 @@ func (m *Model) isModified(path *shared.RelativePath) bool {
 	return true
 }
 
+/*
+isMoved returns true if the object is known locally, but under a different path.
+*/
+func (m *Model) isMoved(obj *shared.ObjectInfo) bool {
+	subpath, err := m.getSubPath(obj.Identification)
+	return err == nil && subpath != obj.Path
+}
+
 /*
 parentsExist takes the path and ensures that each parent object exists in the.
 If this is not the case it returns false.
@@ -807,7 +1242,7 @@ If this is not the case it returns false.
 func (m *Model) parentsExist(path *shared.RelativePath) bool {
 	for !path.AtRoot() {
 		path = path.Up()
-		if !m.IsTracked(path.FullPath()) {
+		if !m.isTracked(path.FullPath()) {
 			return false
 		}
 	}
@@ -815,15 +1250,22 @@ func (m *Model) parentsExist(path *shared.RelativePath) bool {
 }
 
 /*
-applyFile from temp dir to correct path. Checks and executes the move.
+applyFile from temp dir to correct path. Checks and executes the move. If instead
+of the complete file only a delta exists, it is applied against the file at
+basePath and verified against the content hash. An empty basePath means that no
+local file is the base of the delta, so the complete file is required.
 */
-func (m *Model) applyFile(identification string, path string) error {
+func (m *Model) applyFile(identification, basePath, path, content string) error {
 	// path to were the modified file sits before being applied
 	temppath := m.RootPath + "/" + shared.TINZENITEDIR + "/" + shared.TEMPDIR + "/" + identification
 	// check that it exists
 	_, err := os.Lstat(temppath)
 	if err != nil {
-		return errMissingUpdateFile
+		// may be a delta instead
+		if _, err := os.Lstat(temppath + deltaSuffix); err == nil && basePath != "" {
+			return m.applyDelta(temppath+deltaSuffix, basePath, path, content)
+		}
+		return ErrMissingUpdateFile
 	}
 	// move file from temp to correct path, overwritting old version
 	return os.Rename(temppath, path)
@@ -834,21 +1276,18 @@ Notify the channel of the operation for the object at path.
 */
 func (m *Model) notify(op shared.Operation, obj *shared.ObjectInfo) {
 	if obj == nil {
-		m.warn("notify: called with invalid obj!")
+		m.warn("Notify: called with invalid obj!", Fields{Operation: op.String()})
 		return
 	}
 	// TODO this catches a bug which shouldn't even be turning up, FIXME
 	if obj.Version.IsEmpty() && op == shared.OpModify {
-		m.warn("notify: object for " + obj.Path + " has empty version on " + op.String() + " operation!")
+		m.warn("Notify: object has empty version!", Fields{Path: obj.Path, Identification: obj.Identification, Operation: op.String()})
 		return
 	}
-	if m.updatechan != nil {
-		if obj == nil {
-			m.log("Failed to notify due to nil obj!")
-			return
-		}
-		m.updatechan <- shared.CreateUpdateMessage(op, *obj)
-	}
+	// the version is shared with the model, so messages must get their own
+	msg := shared.CreateUpdateMessage(op, *obj)
+	msg.Object.Version = mergeVersions(obj.Version, nil)
+	m.getBus().publish(msg)
 }
 
 /*
@@ -856,21 +1295,29 @@ populateMap for the m.root path with all file and directory contents, with the
 matcher applied if applicable.
 */
 func (m *Model) populateMap() (map[string]bool, error) {
-	return m.partialPopulateMap(m.RootPath)
+	return m.partialPopulateMap(context.Background(), m.RootPath)
 }
 
 /*
 partialPopulateMap for the given path with all file and directory contents within
-the given path, with the matcher applied if applicable.
+the given path, with the matcher applied if applicable. The walk is aborted if
+the context is canceled.
 */
-func (m *Model) partialPopulateMap(rootPath string) (map[string]bool, error) {
+func (m *Model) partialPopulateMap(ctx context.Context, rootPath string) (map[string]bool, error) {
 	relPath := shared.CreatePathRoot(m.RootPath).Apply(rootPath)
-	master, err := CreateMatcher(relPath.RootPath())
+	// the matcher is shared by all walks
+	m.scanning.Lock()
+	defer m.scanning.Unlock()
+	master, err := refreshMatcher(m.matcher, relPath.RootPath())
 	if err != nil {
 		return nil, err
 	}
+	m.matcher = master
 	tracked := make(map[string]bool)
-	filepath.Walk(relPath.FullPath(), func(subpath string, stat os.FileInfo, inerr error) error {
+	err = filepath.Walk(relPath.FullPath(), func(subpath string, stat os.FileInfo, inerr error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		// if we have an error or stat is nil, handle this error (can happen if objects get ignored since last populate)
 		if inerr != nil || stat == nil {
 			// we ignore this dir, equating it to a removal, so just return nil
@@ -880,11 +1327,10 @@ func (m *Model) partialPopulateMap(rootPath string) (map[string]bool, error) {
 		// sanity check
 		thisPath := relPath.Apply(subpath)
 		if thisPath.FullPath() != subpath {
-			m.log("Failed to walk due to wrong path!", thisPath.FullPath())
+			m.warn("Walk: wrong path!", Fields{Path: thisPath.FullPath()})
 			return nil
 		}
-		// resolve matcher
-		/*FIXME thie needlessly creates a lot of potential duplicates*/
+		// resolve matcher (cached per directory, so cheap)
 		match := master.Resolve(thisPath)
 		// ignore on match
 		if match.Ignore(thisPath.FullPath()) {
@@ -898,25 +1344,11 @@ func (m *Model) partialPopulateMap(rootPath string) (map[string]bool, error) {
 		tracked[thisPath.SubPath()] = true
 		return nil
 	})
+	// only cancellation aborts the walk
+	if err != nil {
+		return nil, err
+	}
 	// doesn't directly assign to m.tracked on purpose so that we can reuse this
 	// method elsewhere (for the current structure on m.Update())
 	return tracked, nil
 }
-
-/*
-Log function that respects the AllowLogging flag.
-*/
-func (m *Model) log(msg ...string) {
-	toPrint := []string{"Model:"}
-	toPrint = append(toPrint, msg...)
-	log.Println(strings.Join(toPrint, " "))
-}
-
-/*
-Warn function.
-*/
-func (m *Model) warn(msg ...string) {
-	toPrint := []string{"Model:", "WARNING:"}
-	toPrint = append(toPrint, msg...)
-	log.Println(strings.Join(toPrint, " "))
-}
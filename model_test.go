@@ -1,9 +1,17 @@
 package model
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"log"
+	"math/rand"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/tinzenite/shared"
 )
@@ -58,6 +66,267 @@ func TestLoad(t *testing.T) {
 	}
 }
 
+func TestLoad_Backup(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	storePath := root + "/" + shared.STOREMODELDIR
+	model, _ := Create(root, PEERID, storePath)
+	model.Update()
+	err := model.Store()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// second store keeps the first as backup
+	err = model.Store()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := len(model.StaticInfos)
+	// journal of the second store must not be replayed onto the backup
+	_ = ioutil.WriteFile(root+"/journaled.txt", []byte("journaled"), shared.FILEPERMISSIONMODE)
+	_ = model.Update()
+	// simulate a crash mid write
+	_ = ioutil.WriteFile(storePath+"/"+shared.MODELJSON, []byte("{\"RootPath\": \"/tm"), shared.FILEPERMISSIONMODE)
+	loaded, err := LoadFrom(storePath)
+	if err != nil {
+		t.Fatal("Expected backup to be loaded, got", err)
+	}
+	if len(loaded.StaticInfos) != stored || loaded.IsTracked(root+"/journaled.txt") {
+		t.Error("Expected", stored, "objects, got", len(loaded.StaticInfos))
+	}
+	// without a backup the error must be returned
+	os.Remove(storePath + "/" + shared.MODELJSON + backupSuffix)
+	_, err = LoadFrom(storePath)
+	if err == nil {
+		t.Error("Expected corrupt model to fail")
+	}
+}
+
+func TestLoad_Migrate(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	storePath := root + "/" + shared.STOREMODELDIR
+	model, _ := Create(root, PEERID, storePath)
+	model.Update()
+	// write the model as an older version would have
+	var raw map[string]interface{}
+	data, _ := json.Marshal(model)
+	_ = json.Unmarshal(data, &raw)
+	for _, key := range []string{"Schema", "Conflicts", "Chunking", "Sequence", "Generation", "HistoryLimit"} {
+		delete(raw, key)
+	}
+	for _, stin := range raw["StaticInfos"].(map[string]interface{}) {
+		delete(stin.(map[string]interface{}), "Size")
+		delete(stin.(map[string]interface{}), "Mode")
+	}
+	data, _ = json.Marshal(raw)
+	_ = ioutil.WriteFile(storePath+"/"+shared.MODELJSON, data, shared.FILEPERMISSIONMODE)
+	loaded, err := LoadFrom(storePath)
+	if err != nil {
+		t.Fatal("Load failed:", err)
+	}
+	if loaded.Schema != modelSchema {
+		t.Error("Expected schema", modelSchema, "got", loaded.Schema)
+	}
+	if loaded.Conflicts == nil || loaded.Chunking || loaded.Sequence != 0 || loaded.Generation != 0 || loaded.HistoryLimit != 0 {
+		t.Error("Expected defaults for fields missing in older versions")
+	}
+	for subpath, stin := range model.StaticInfos {
+		if loaded.StaticInfos[subpath].Size != stin.Size {
+			t.Error("Expected size of", subpath, "to be migrated")
+		}
+		if loaded.StaticInfos[subpath].Mode != stin.Mode {
+			t.Error("Expected mode of", subpath, "to be migrated")
+		}
+	}
+	// newer models must not be loaded, not even from a valid backup
+	loaded.Store()
+	loaded.Store()
+	raw["Schema"] = modelSchema + 1
+	data, _ = json.Marshal(raw)
+	_ = ioutil.WriteFile(storePath+"/"+shared.MODELJSON, data, shared.FILEPERMISSIONMODE)
+	_, err = LoadFrom(storePath)
+	if err != ErrIncompatibleModel {
+		t.Error("Expected", ErrIncompatibleModel, "got", err)
+	}
+}
+
+func TestLoad_Journal(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	storePath := root + "/" + shared.STOREMODELDIR
+	model, _ := Create(root, PEERID, storePath)
+	// first update stores the complete model
+	model.Update()
+	snapshot, _ := ioutil.ReadFile(storePath + "/" + shared.MODELJSON)
+	// further changes must only be journaled
+	_ = ioutil.WriteFile(root+"/journaled.txt", []byte("journaled"), shared.FILEPERMISSIONMODE)
+	err := model.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unchanged, _ := ioutil.ReadFile(storePath + "/" + shared.MODELJSON)
+	if string(unchanged) != string(snapshot) {
+		t.Error("Expected stored model to be unchanged")
+	}
+	// simulate crash while appending
+	file, _ := os.OpenFile(storePath+"/"+journalFile, os.O_WRONLY|os.O_APPEND, shared.FILEPERMISSIONMODE)
+	file.WriteString("{\"seq\": 99, \"op\": \"del\", \"pa")
+	file.Close()
+	loaded, err := LoadFrom(storePath)
+	if err != nil {
+		t.Fatal("Load failed:", err)
+	}
+	if !loaded.IsTracked(root + "/journaled.txt") {
+		t.Error("Expected journaled file to be tracked after load")
+	}
+	if loaded.Sequence != model.Sequence {
+		t.Error("Expected sequence", model.Sequence, "got", loaded.Sequence)
+	}
+	// the loaded model must be able to continue the journal
+	os.Remove(root + "/journaled.txt")
+	err = loaded.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := LoadFrom(storePath)
+	if err != nil {
+		t.Fatal("Load failed:", err)
+	}
+	if reloaded.IsTracked(root + "/journaled.txt") {
+		t.Error("Expected removed file to be untracked after load")
+	}
+	// storing compacts the journal
+	reloaded.Store()
+	if exists, _ := shared.FileExists(storePath + "/" + journalFile); exists {
+		t.Error("Expected journal to be removed")
+	}
+}
+
+func TestLoad_ConcurrentGetSubPath(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	storePath := root + "/" + shared.STOREMODELDIR
+	model, _ := Create(root, PEERID, storePath)
+	model.Update()
+	loaded, err := LoadFrom(storePath)
+	if err != nil {
+		t.Fatal("Load failed:", err)
+	}
+	// readers must not race on the index right after loading (run with -race)
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func() {
+			for subpath, stin := range model.StaticInfos {
+				found, err := loaded.GetSubPath(stin.Identification)
+				if err != nil || found != subpath {
+					t.Error("Expected", stin.Identification, "to be found at", subpath, "got", found)
+				}
+			}
+			done <- true
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+}
+
+func TestLoadFromStorage(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	storePath := root + "/" + shared.STOREMODELDIR
+	storage := NewMemoryStorage()
+	model, _ := Create(root, PEERID, storePath)
+	err := model.SetStorage(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	model.Update()
+	_ = ioutil.WriteFile(root+"/journaled.txt", []byte("journaled"), shared.FILEPERMISSIONMODE)
+	model.Update()
+	// the model must not touch the disk
+	if exists, _ := shared.FileExists(storePath + "/" + shared.MODELJSON); exists {
+		t.Error("Expected model to not be written to disk")
+	}
+	names := storage.Names()
+	if len(names) != 2 || names[0] != journalFile || names[1] != shared.MODELJSON {
+		t.Error("Expected model and journal in storage, got", names)
+	}
+	loaded, err := LoadFromStorage(storage)
+	if err != nil {
+		t.Fatal("Load failed:", err)
+	}
+	if len(loaded.StaticInfos) != len(model.StaticInfos) || !loaded.IsTracked(root+"/journaled.txt") {
+		t.Error("Expected loaded model to equal stored one")
+	}
+	// check with wrong parameter
+	_, err = LoadFromStorage(nil)
+	if err != shared.ErrIllegalParameters {
+		t.Error("Expected", shared.ErrIllegalParameters, "got", err)
+	}
+}
+
+func TestLoadFromStorage_FailedAppend(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	storage := &failingStorage{MemoryStorage: NewMemoryStorage()}
+	model, _ := Create(root, PEERID, root+"/"+shared.STOREMODELDIR)
+	_ = model.SetStorage(storage)
+	model.Update()
+	// an append that only writes part of the records
+	storage.failAppend = true
+	_ = ioutil.WriteFile(root+"/failed.txt", []byte("failed"), shared.FILEPERMISSIONMODE)
+	err := model.Update()
+	if err == nil {
+		t.Fatal("Expected failed append to be reported")
+	}
+	storage.failAppend = false
+	_ = ioutil.WriteFile(root+"/later.txt", []byte("later"), shared.FILEPERMISSIONMODE)
+	err = model.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadFromStorage(storage)
+	if err != nil {
+		t.Fatal("Load failed:", err)
+	}
+	if !loaded.IsTracked(root+"/failed.txt") || !loaded.IsTracked(root+"/later.txt") {
+		t.Error("Expected all changes to survive a failed append")
+	}
+}
+
+func TestLoadFromStorage_FailedStore(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	storage := &failingStorage{MemoryStorage: NewMemoryStorage()}
+	model, _ := Create(root, PEERID, root+"/"+shared.STOREMODELDIR)
+	_ = model.SetStorage(storage)
+	model.Update()
+	model.Store()
+	_ = storage.Write(shared.MODELJSON, []byte("{\"RootPath\": \"/tm"))
+	loaded, err := LoadFromStorage(storage)
+	if err != nil {
+		t.Fatal("Expected backup to be loaded, got", err)
+	}
+	// the corrupt model must not replace the backup, even if storing fails
+	storage.failWrite = true
+	err = loaded.Store()
+	if err == nil {
+		t.Fatal("Expected failed write to be reported")
+	}
+	storage.failWrite = false
+	_, err = LoadFromStorage(storage)
+	if err != nil {
+		t.Error("Expected backup to be kept, got", err)
+	}
+	// once stored the model is rotated as usual
+	_ = loaded.Store()
+	_ = loaded.Store()
+	if names := storage.Names(); len(names) != 2 || names[1] != shared.MODELJSON+backupSuffix {
+		t.Error("Expected model and backup, got", names)
+	}
+}
+
 func TestModel_IsEmpty(t *testing.T) {
 	root := makeDefaultDirectory()
 	defer removeTemp(root)
@@ -115,6 +384,66 @@ func TestModel_Update(t *testing.T) {
 	}
 }
 
+func TestModel_UpdateContext(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	model, _ := Create(root, PEERID, root+"/"+shared.STOREMODELDIR)
+	_ = model.Update()
+	file := makeTempFile(root, FOUR)
+	// canceled updates must not apply anything
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := model.UpdateContext(ctx)
+	if err != context.Canceled {
+		t.Error("Expected", context.Canceled, "got", err)
+	}
+	if model.IsTracked(file) {
+		t.Error("Expected canceled update to not track file")
+	}
+	err = model.UpdateContext(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
+	if !model.IsTracked(file) {
+		t.Error("Expected update to track file")
+	}
+	// hashing itself stops once canceled
+	stat, _ := os.Lstat(file)
+	if _, err = computeDigest(ctx, file, stat, true); err != context.Canceled {
+		t.Error("Expected", context.Canceled, "got", err)
+	}
+}
+
+func TestModel_SetHashWorkers(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	model, _ := Create(root, PEERID, root+"/"+shared.STOREMODELDIR)
+	if model.SetHashWorkers(0) != shared.ErrIllegalParameters {
+		t.Error("Expected", shared.ErrIllegalParameters, "for zero workers")
+	}
+	err := model.SetHashWorkers(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for i := 0; i < 50; i++ {
+		file := makeTempFile(root, FOUR)
+		_ = ioutil.WriteFile(file, []byte(file), shared.FILEPERMISSIONMODE)
+		files = append(files, file)
+	}
+	err = model.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relPath := shared.CreatePathRoot(root)
+	for _, file := range files {
+		hash, _ := shared.ContentHash(file)
+		if model.StaticInfos[relPath.Apply(file).SubPath()].Content != hash {
+			t.Error("Expected correct hash for", file)
+		}
+	}
+}
+
 func TestModel_PartialUpdate(t *testing.T) {
 	root := makeDefaultDirectory()
 	defer removeTemp(root)
@@ -150,6 +479,984 @@ func TestModel_PartialUpdate(t *testing.T) {
 	}
 }
 
+func TestModel_UpdateMove(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	// create model
+	model, _ := Create(root, PEERID, root+"/"+shared.STOREMODELDIR)
+	_ = model.Update()
+	updates := make(chan shared.UpdateMessage, 100)
+	model.Register(updates)
+	// create a file and a directory to rename
+	file := makeTempFile(root, FOUR)
+	_ = ioutil.WriteFile(file, []byte("moving content"), shared.FILEPERMISSIONMODE)
+	_ = model.Update()
+	fileID, _ := model.GetIdentification(shared.CreatePathRoot(root).Apply(file))
+	subdir := makeTempDir(root, "movedir")
+	_ = makeTempFile(subdir, ONE)
+	_ = makeTempFile(subdir, TWO)
+	_ = model.Update()
+	dirID, _ := model.GetIdentification(shared.CreatePathRoot(root).Apply(subdir))
+	// now rename both
+	os.Rename(file, root+"/renamed")
+	os.Rename(subdir, root+"/moveddir")
+	// drain notifies of setup
+	for len(updates) > 0 {
+		<-updates
+	}
+	err := model.Update()
+	if err != nil {
+		t.Error(err)
+	}
+	if id, _ := model.GetIdentification(shared.CreatePath(root, "renamed")); id != fileID {
+		t.Error("Expected renamed file to keep identification", fileID, "got", id)
+	}
+	if id, _ := model.GetIdentification(shared.CreatePath(root, "moveddir")); id != dirID {
+		t.Error("Expected renamed directory to keep identification", dirID, "got", id)
+	}
+	if model.IsTracked(file) || model.IsTracked(subdir) {
+		t.Error("Expected old paths to be untracked")
+	}
+	// expect exactly the two moves sent as modifies of the new paths and nothing else
+	var moved *shared.ObjectInfo
+	moves := 0
+	for len(updates) > 0 {
+		um := <-updates
+		if strings.HasPrefix(um.Object.Path, shared.TINZENITEDIR) {
+			continue
+		}
+		if um.Operation != shared.OpModify || (um.Object.Path != "renamed" && um.Object.Path != "moveddir") {
+			t.Error("Expected only modifies of the new paths, got", um.Operation, "for", um.Object.Path)
+			continue
+		}
+		if um.Object.Version[PEERID] != 1 {
+			t.Error("Expected version of move to be increased, got", um.Object.Version)
+		}
+		if um.Object.Path == "renamed" {
+			obj := um.Object
+			moved = &obj
+		}
+		moves++
+	}
+	if moves != 2 || moved == nil {
+		t.Fatal("Expected 2 moves, got", moves)
+	}
+	// remote moves of unchanged files are applied without any file in temp
+	moved.Path = "remote"
+	moved.Name = "remote"
+	moved.Version = mergeVersions(moved.Version, nil)
+	moved.Version.Increase("otherpeer")
+	um := shared.CreateUpdateMessage(shared.OpModify, *moved)
+	_, err = model.CheckMessage(&um)
+	if err != nil || um.Operation != shared.OpModify {
+		t.Fatal("Expected move to be accepted as modify, got", um.Operation, err)
+	}
+	err = model.ApplyUpdateMessage(&um)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := model.GetIdentification(shared.CreatePath(root, "remote")); id != fileID || model.IsTracked(root+"/renamed") {
+		t.Error("Expected file to have been moved remotely, got", id)
+	}
+	if data, _ := ioutil.ReadFile(root + "/remote"); string(data) != "moving content" {
+		t.Error("Expected content to be kept, got", string(data))
+	}
+	// empty directories all look alike, so they are removed and created instead
+	_ = os.Mkdir(root+"/emptyold", shared.FILEPERMISSIONMODE)
+	_ = model.Update()
+	emptyID, _ := model.GetIdentification(shared.CreatePath(root, "emptyold"))
+	_ = os.Remove(root + "/emptyold")
+	_ = os.Mkdir(root+"/emptynew", shared.FILEPERMISSIONMODE)
+	_ = model.Update()
+	if id, _ := model.GetIdentification(shared.CreatePath(root, "emptynew")); id == emptyID || model.IsTracked(root+"/emptyold") {
+		t.Error("Expected empty directory not to be moved, got", id)
+	}
+}
+
+func TestModel_GetSubPath(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	model, _ := Create(root, PEERID, root+"/"+shared.STOREMODELDIR)
+	_ = model.Update()
+	checkIndex(t, model)
+	// moves, creations, and removals must all keep the index consistent
+	subdir := makeTempDir(root, "indexdir")
+	_ = makeTempFile(subdir, ONE)
+	_ = model.Update()
+	checkIndex(t, model)
+	os.Rename(subdir, root+"/movedindex")
+	_ = model.Update()
+	checkIndex(t, model)
+	os.RemoveAll(root + "/movedindex")
+	_ = model.Update()
+	checkIndex(t, model)
+	// as must loading
+	model.Store()
+	loaded, err := LoadFrom(root + "/" + shared.STOREMODELDIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIndex(t, loaded)
+	_, err = model.GetSubPath("unknown")
+	if err == nil {
+		t.Error("Expected unknown identification to fail")
+	}
+}
+
+func TestModel_ApplyModifyDirectory(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	// create model
+	model, _ := Create(root, PEERID, root+"/"+shared.STOREMODELDIR)
+	subdir := makeTempDir(root, "moddir")
+	child := makeTempFile(subdir, ONE)
+	_ = model.Update()
+	relPath := shared.CreatePathRoot(root)
+	// local metadata change must increase the version
+	os.Chmod(subdir, 0750)
+	_ = model.Update()
+	dirObj, err := model.GetInfo(relPath.Apply(subdir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dirObj.Version[PEERID] != 1 {
+		t.Error("Expected directory version to be increased, got", dirObj.Version)
+	}
+	if dirObj.Content != "0750" {
+		t.Error("Expected permissions to be sent as content, got", dirObj.Content)
+	}
+	childID, _ := model.GetIdentification(relPath.Apply(child))
+	// a rename that fails the checks must not touch the disk
+	dirObj.Path = "renamed"
+	dirObj.Name = "renamed"
+	dirObj.Version = shared.CreateVersion()
+	dirObj.Version.Increase("otherpeer")
+	err = model.ApplyModify(shared.CreatePath(root, "renamed"), dirObj)
+	if !errors.Is(err, shared.ErrConflict) {
+		t.Error("Expected", shared.ErrConflict, "got", err)
+	}
+	if exists, _ := shared.DirectoryExists(subdir); !exists || !model.IsTracked(subdir) {
+		t.Error("Expected directory to stay in place")
+	}
+	// remote rename must move the whole subtree and apply the permissions
+	dirObj.Version = mergeVersions(dirObj.Version, map[string]int{PEERID: 1})
+	dirObj.Content = "0700"
+	err = model.ApplyModify(shared.CreatePath(root, "renamed"), dirObj)
+	if err != nil {
+		t.Error(err)
+	}
+	if stat, _ := os.Lstat(root + "/renamed"); stat == nil || stat.Mode().Perm() != 0700 {
+		t.Error("Expected remote permissions to be applied")
+	}
+	if model.IsTracked(subdir) || !model.IsTracked(root+"/renamed") {
+		t.Error("Expected directory to be tracked under new path only")
+	}
+	movedChild := relPath.Apply(root + "/renamed/" + relPath.Apply(child).LastElement())
+	if id, _ := model.GetIdentification(movedChild); id != childID {
+		t.Error("Expected child to keep identification", childID, "got", id)
+	}
+	if exists, _ := shared.FileExists(movedChild.FullPath()); !exists {
+		t.Error("Expected child to have been moved on disk")
+	}
+}
+
+func TestModel_ApplyModifyConflict(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	// create model
+	model, _ := Create(root, PEERID, root+"/"+shared.STOREMODELDIR)
+	file := root + "/conflict.txt"
+	_ = ioutil.WriteFile(file, []byte("original"), shared.FILEPERMISSIONMODE)
+	_ = model.Update()
+	path := shared.CreatePathRoot(root).Apply(file)
+	remoteObj, _ := model.GetInfo(path)
+	// local change that hasn't been applied to the model yet
+	_ = ioutil.WriteFile(file, []byte("local change"), shared.FILEPERMISSIONMODE)
+	// remote change waiting in temp (version is copied as GetInfo shares it with the model)
+	remoteObj.Version = mergeVersions(remoteObj.Version, nil)
+	remoteObj.Version.Increase("otherpeer")
+	_ = ioutil.WriteFile(root+"/"+shared.TINZENITEDIR+"/"+shared.TEMPDIR+"/"+remoteObj.Identification, []byte("remote change"), shared.FILEPERMISSIONMODE)
+	err := model.ApplyModify(path, remoteObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// remote wins as both changed once and otherpeer sorts before PEERID
+	data, _ := ioutil.ReadFile(file)
+	if string(data) != "remote change" {
+		t.Error("Expected remote file to win, got", string(data))
+	}
+	localObj, _ := model.GetInfo(path)
+	if !localObj.Version.Includes(remoteObj.Version) || localObj.Version.Equal(remoteObj.Version) {
+		t.Error("Expected merged version to supersede remote version, got", localObj.Version)
+	}
+	// local version must be tracked as conflict copy
+	var copies []string
+	for subpath := range model.TrackedPaths {
+		if strings.HasPrefix(subpath, "conflict (conflict "+PEERID+" ") && strings.HasSuffix(subpath, ").txt") {
+			copies = append(copies, subpath)
+		}
+	}
+	if len(copies) != 1 {
+		t.Fatal("Expected exactly one conflict copy, got", copies)
+	}
+	data, _ = ioutil.ReadFile(root + "/" + copies[0])
+	if string(data) != "local change" {
+		t.Error("Expected conflict copy to contain local version, got", string(data))
+	}
+	// conflict must be registered
+	conflicts := model.ListConflicts()
+	if len(conflicts) != 1 || conflicts[0].Path != "conflict.txt" || conflicts[0].Copy != copies[0] || !conflicts[0].CopyLocal || conflicts[0].Peer != "otherpeer" {
+		t.Fatal("Expected conflict to be listed, got", conflicts)
+	}
+	// resolve by keeping the local version
+	err = model.ResolveConflict(path, KeepLocal)
+	if err != nil {
+		t.Error(err)
+	}
+	data, _ = ioutil.ReadFile(file)
+	if string(data) != "local change" {
+		t.Error("Expected local version to be kept, got", string(data))
+	}
+	if model.IsTracked(root+"/"+copies[0]) || len(model.ListConflicts()) != 0 {
+		t.Error("Expected conflict to be resolved")
+	}
+	if model.ResolveConflict(path, KeepBoth) != ErrNoConflict {
+		t.Error("Expected", ErrNoConflict)
+	}
+}
+
+func TestModel_ConflictRegistry(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	// create model
+	model, _ := Create(root, PEERID, root+"/"+shared.STOREMODELDIR)
+	_ = ioutil.WriteFile(root+"/a.txt", []byte("a"), shared.FILEPERMISSIONMODE)
+	_ = ioutil.WriteFile(root+"/b.txt", []byte("b"), shared.FILEPERMISSIONMODE)
+	_ = model.Update()
+	relPath := shared.CreatePathRoot(root)
+	// remote move of a.txt onto the existing b.txt
+	remoteObj, _ := model.GetInfo(relPath.Apply(root + "/a.txt"))
+	remoteObj.Path = "b.txt"
+	remoteObj.Name = "b.txt"
+	remoteObj.Version = mergeVersions(remoteObj.Version, nil)
+	remoteObj.Version.Increase("otherpeer")
+	_, err := model.CheckMessage(&shared.UpdateMessage{Operation: shared.OpModify, Object: *remoteObj})
+	if !errors.Is(err, shared.ErrConflict) {
+		t.Fatal("Expected conflict, got", err)
+	}
+	conflicts := model.ListConflicts()
+	if len(conflicts) != 1 || conflicts[0].Path != "b.txt" || conflicts[0].Copy != "" || conflicts[0].Peer != "otherpeer" {
+		t.Fatal("Expected conflict without copy, got", conflicts)
+	}
+	if model.ResolveConflict(relPath.Apply(root+"/b.txt"), KeepRemote) != ErrNoRemoteVersion {
+		t.Error("Expected", ErrNoRemoteVersion)
+	}
+	// conflict must follow a local move
+	_ = os.Rename(root+"/b.txt", root+"/c.txt")
+	_ = model.Update()
+	conflicts = model.ListConflicts()
+	if len(conflicts) != 1 || conflicts[0].Path != "c.txt" {
+		t.Fatal("Expected conflict to be moved, got", conflicts)
+	}
+	// and be dropped on removal
+	_ = os.Remove(root + "/c.txt")
+	_ = model.Update()
+	if len(model.ListConflicts()) != 0 {
+		t.Error("Expected conflict to be dropped, got", model.ListConflicts())
+	}
+}
+
+func TestModel_ConflictConverges(t *testing.T) {
+	var roots []string
+	var models []*Model
+	var updates []chan shared.UpdateMessage
+	for _, peer := range []string{"peera", "peerb"} {
+		root, _ := ioutil.TempDir("", ROOT)
+		defer removeTemp(root)
+		shared.MakeDotTinzenite(root)
+		model, _ := Create(root, peer, root+"/"+shared.STOREMODELDIR)
+		// only changes after the initial state are exchanged
+		_ = model.Update()
+		channel := make(chan shared.UpdateMessage, 100)
+		model.Register(channel)
+		roots = append(roots, root)
+		models = append(models, model)
+		updates = append(updates, channel)
+	}
+	type sent struct {
+		msg  shared.UpdateMessage
+		data []byte
+	}
+	// send takes all pending messages of a model together with their files
+	send := func(from int) []sent {
+		var list []sent
+		for {
+			select {
+			case msg := <-updates[from]:
+				if strings.HasPrefix(msg.Object.Path, shared.TINZENITEDIR) {
+					continue
+				}
+				data, _ := ioutil.ReadFile(roots[from] + "/" + msg.Object.Path)
+				list = append(list, sent{msg: msg, data: data})
+			default:
+				return list
+			}
+		}
+	}
+	// receive applies the sent messages like a peer would
+	receive := func(to int, list []sent) {
+		for _, item := range list {
+			msg := item.msg
+			if !msg.Object.Directory && msg.Operation != shared.OpRemove {
+				_ = ioutil.WriteFile(roots[to]+"/"+shared.TINZENITEDIR+"/"+shared.TEMPDIR+"/"+msg.Object.Identification, item.data, shared.FILEPERMISSIONMODE)
+			}
+			checked, err := models[to].CheckMessage(&msg)
+			if errors.Is(err, ErrIgnoreUpdate) {
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = models[to].ApplyUpdateMessage(checked)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// shared file known to both
+	_ = ioutil.WriteFile(roots[0]+"/shared.txt", []byte("original"), shared.FILEPERMISSIONMODE)
+	_ = models[0].Update()
+	receive(1, send(0))
+	_ = send(1)
+	// concurrent changes on both sides, sent at the same time
+	for i, model := range models {
+		_ = ioutil.WriteFile(roots[i]+"/shared.txt", []byte("change of "+model.SelfID), shared.FILEPERMISSIONMODE)
+		_ = model.Update()
+	}
+	for round := 0; round < 3; round++ {
+		fromA, fromB := send(0), send(1)
+		receive(1, fromA)
+		receive(0, fromB)
+	}
+	// both sides must have settled on the same state
+	count := 0
+	for subpath, stin := range models[0].StaticInfos {
+		// only the shared file and its copy are known to both
+		if !strings.HasPrefix(subpath, "shared") {
+			continue
+		}
+		count++
+		other, exists := models[1].StaticInfos[subpath]
+		if !exists || other.Identification != stin.Identification || !other.Version.Equal(stin.Version) {
+			t.Error("Expected", subpath, "to be equal on both peers")
+		}
+		dataA, _ := ioutil.ReadFile(roots[0] + "/" + subpath)
+		dataB, _ := ioutil.ReadFile(roots[1] + "/" + subpath)
+		if !bytes.Equal(dataA, dataB) {
+			t.Error("Expected same content for", subpath, "got", string(dataA), string(dataB))
+		}
+	}
+	if count != 2 || len(models[0].StaticInfos) != len(models[1].StaticInfos) {
+		t.Error("Expected file and conflict copy on both peers, got", models[0].TrackedPaths, models[1].TrackedPaths)
+	}
+	data, _ := ioutil.ReadFile(roots[0] + "/shared.txt")
+	if string(data) != "change of peera" {
+		t.Error("Expected change of peera to win, got", string(data))
+	}
+	if len(models[0].ListConflicts()) != 1 || len(models[1].ListConflicts()) != 1 {
+		t.Error("Expected conflict to be listed on both peers")
+	}
+}
+
+func TestModel_MissingBlocks(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	// create model
+	model, _ := Create(root, PEERID, root+"/"+shared.STOREMODELDIR)
+	model.Chunking = true
+	// write large file with random content
+	data := make([]byte, 8*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	file := root + "/large.bin"
+	_ = ioutil.WriteFile(file, data, shared.FILEPERMISSIONMODE)
+	_ = model.Update()
+	path := shared.CreatePathRoot(root).Apply(file)
+	oldBlocks, err := model.GetBlocks(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(oldBlocks) < 2 {
+		t.Fatal("Expected multiple blocks, got", len(oldBlocks))
+	}
+	// hash and blocks are computed in the same pass
+	hash, _ := shared.ContentHash(file)
+	stin := model.StaticInfos["large.bin"]
+	blocks, _ := chunkFile(file)
+	if stin.Content != hash || len(blocks) != len(oldBlocks) || blocks[1] != oldBlocks[1] {
+		t.Error("Expected single pass to match ContentHash and chunkFile")
+	}
+	// change a single byte
+	data[len(data)/2]++
+	_ = ioutil.WriteFile(file, data, shared.FILEPERMISSIONMODE)
+	_ = model.Update()
+	newBlocks, _ := model.GetBlocks(path)
+	// a remote peer with the old version only needs the changed block
+	missing := missingBlocks(oldBlocks, newBlocks)
+	if len(missing) != 1 {
+		t.Error("Expected exactly one missing block, got", len(missing), "of", len(newBlocks))
+	}
+	// nothing is missing locally
+	missing, _ = model.MissingBlocks(path, newBlocks)
+	if len(missing) != 0 {
+		t.Error("Expected no missing blocks, got", len(missing))
+	}
+}
+
+func TestModel_ApplyModifyDelta(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	// create model
+	model, _ := Create(root, PEERID, root+"/"+shared.STOREMODELDIR)
+	data := make([]byte, 8*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	file := root + "/patched.bin"
+	_ = ioutil.WriteFile(file, data, shared.FILEPERMISSIONMODE)
+	_ = model.Update()
+	path := shared.CreatePathRoot(root).Apply(file)
+	localBlocks, _ := model.GetBlocks(path)
+	// remote version lives somewhere else
+	remoteData := append([]byte("prefix"), data...)
+	remoteFile := makeTempFile(os.TempDir(), FOUR)
+	defer removeTemp(remoteFile)
+	_ = ioutil.WriteFile(remoteFile, remoteData, shared.FILEPERMISSIONMODE)
+	remoteObj, _ := model.GetInfo(path)
+	remoteObj.Version = mergeVersions(remoteObj.Version, nil)
+	remoteObj.Version.Increase("otherpeer")
+	remoteObj.Content, _ = shared.ContentHash(remoteFile)
+	// write delta for our local blocks to temp
+	deltaPath := root + "/" + shared.TINZENITEDIR + "/" + shared.TEMPDIR + "/" + remoteObj.Identification + deltaSuffix
+	deltaFile, _ := os.Create(deltaPath)
+	err := writeDelta(remoteFile, localBlocks, deltaFile)
+	deltaFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat, _ := os.Lstat(deltaPath); stat.Size() >= int64(len(remoteData)) {
+		t.Error("Expected delta to be smaller than the file")
+	}
+	err = model.ApplyModify(path, remoteObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, _ := ioutil.ReadFile(file)
+	if string(result) != string(remoteData) {
+		t.Error("Expected file to contain remote data after applying delta")
+	}
+	if exists, _ := shared.FileExists(deltaPath); exists {
+		t.Error("Expected delta to be removed")
+	}
+	// in a conflict the local file isn't the base, so the delta must not be applied
+	remoteBlocks, _ := chunkFile(remoteFile)
+	_ = ioutil.WriteFile(remoteFile, append([]byte("again"), remoteData...), shared.FILEPERMISSIONMODE)
+	_ = ioutil.WriteFile(file, []byte("local change"), shared.FILEPERMISSIONMODE)
+	remoteObj.Version = mergeVersions(remoteObj.Version, nil)
+	remoteObj.Version.Increase("otherpeer")
+	remoteObj.Content, _ = shared.ContentHash(remoteFile)
+	deltaFile, _ = os.Create(deltaPath)
+	_ = writeDelta(remoteFile, remoteBlocks, deltaFile)
+	deltaFile.Close()
+	err = model.ApplyModify(path, remoteObj)
+	if !errors.Is(err, ErrMissingUpdateFile) {
+		t.Error("Expected", ErrMissingUpdateFile, "got", err)
+	}
+	result, _ = ioutil.ReadFile(file)
+	if string(result) != "local change" || len(model.ListConflicts()) != 0 {
+		t.Error("Expected local file to be kept until the complete file is available")
+	}
+}
+
+func TestModel_Errors(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	model, _ := Create(root, PEERID, root+"/"+shared.STOREMODELDIR)
+	_ = ioutil.WriteFile(root+"/known", []byte("known"), shared.FILEPERMISSIONMODE)
+	_ = model.Update()
+	obj, _ := model.GetInfo(shared.CreatePath(root, "known"))
+	// known updates must still match the sentinel
+	um := shared.CreateUpdateMessage(shared.OpCreate, *obj)
+	_, err := model.CheckMessage(&um)
+	var modelErr *Error
+	if !errors.Is(err, ErrIgnoreUpdate) || !errors.As(err, &modelErr) {
+		t.Fatal("Expected wrapped", ErrIgnoreUpdate, "got", err)
+	}
+	if modelErr.Op != "create" || modelErr.Path != obj.Path || modelErr.Identification != obj.Identification {
+		t.Error("Expected context of", obj.Path, "got", modelErr)
+	}
+	// previously unexported causes are now inspectable
+	hanging := shared.ObjectInfo{Path: "missing/hanging", Identification: "hanging", Version: shared.CreateVersion()}
+	um = shared.CreateUpdateMessage(shared.OpCreate, hanging)
+	_, err = model.CheckMessage(&um)
+	if !errors.Is(err, ErrParentObjectsMissing) {
+		t.Error("Expected", ErrParentObjectsMissing, "got", err)
+	}
+	remote := shared.ObjectInfo{Path: "fetched", Identification: "fetched", Version: shared.CreateVersion()}
+	err = model.ApplyCreate(shared.CreatePath(root, "fetched"), &remote)
+	if !errors.As(err, &modelErr) || !errors.Is(err, ErrMissingUpdateFile) {
+		t.Fatal("Expected wrapped", ErrMissingUpdateFile, "got", err)
+	}
+	if modelErr.Op != "create" || modelErr.Path != "fetched" || modelErr.Identification != "fetched" {
+		t.Error("Expected context of fetched, got", modelErr)
+	}
+	_, err = model.Sync(nil)
+	if !errors.Is(err, shared.ErrIllegalParameters) {
+		t.Error("Expected", shared.ErrIllegalParameters, "got", err)
+	}
+}
+
+func TestModel_Plan(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	model, _ := Create(root, PEERID, root+"/"+shared.STOREMODELDIR)
+	_ = ioutil.WriteFile(root+"/modified", []byte("old"), shared.FILEPERMISSIONMODE)
+	_ = ioutil.WriteFile(root+"/removed", []byte("removed"), shared.FILEPERMISSIONMODE)
+	_ = model.Update()
+	_ = ioutil.WriteFile(root+"/created", []byte("created"), shared.FILEPERMISSIONMODE)
+	_ = ioutil.WriteFile(root+"/modified", []byte("changed"), shared.FILEPERMISSIONMODE)
+	os.Remove(root + "/removed")
+	plan, err := model.Plan(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, _ := shared.ContentHash(root + "/created")
+	if len(plan.Creates) != 1 || plan.Creates[0].Path != "created" || plan.Creates[0].Content != hash || plan.Creates[0].Size != 7 {
+		t.Error("Expected create of created, got", plan.Creates)
+	}
+	if len(plan.Modifies) != 1 || plan.Modifies[0].Path != "modified" || plan.Modifies[0].Identification == "" {
+		t.Error("Expected modify of modified, got", plan.Modifies)
+	}
+	if len(plan.Removes) != 1 || plan.Removes[0].Path != "removed" {
+		t.Error("Expected remove of removed, got", plan.Removes)
+	}
+	// planning must not touch the model
+	if model.IsTracked(root+"/created") || !model.IsTracked(root+"/removed") {
+		t.Error("Expected model to be unchanged by planning")
+	}
+	// plans only read the model, so they may run concurrently (run with -race)
+	done := make(chan *Plan)
+	for i := 0; i < 4; i++ {
+		go func() {
+			concurrent, _ := model.Plan(root)
+			done <- concurrent
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		if concurrent := <-done; concurrent == nil || !concurrent.matches(plan) {
+			t.Error("Expected concurrent plans to match")
+		}
+	}
+	// a changed disk must be refused
+	_ = ioutil.WriteFile(root+"/created", []byte("created again"), shared.FILEPERMISSIONMODE)
+	err = model.ApplyPlan(plan)
+	if !errors.Is(err, ErrPlanOutdated) {
+		t.Fatal("Expected", ErrPlanOutdated, "got", err)
+	}
+	if model.IsTracked(root + "/created") {
+		t.Error("Expected outdated plan to not be applied")
+	}
+	plan, _ = model.Plan(root)
+	err = model.ApplyPlan(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !model.IsTracked(root+"/created") || model.IsTracked(root+"/removed") {
+		t.Error("Expected plan to be applied")
+	}
+	if plan, _ = model.Plan(root); !plan.IsEmpty() {
+		t.Error("Expected nothing left to do, got", plan)
+	}
+}
+
+func TestModel_Check(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	model, _ := Create(root, PEERID, root+"/"+shared.STOREMODELDIR)
+	for _, name := range []string{"nostin", "untracked", "tampered"} {
+		_ = ioutil.WriteFile(root+"/"+name, []byte(name), shared.FILEPERMISSIONMODE)
+	}
+	_ = model.Update()
+	issues, err := model.Check(false)
+	if err != nil || len(issues) != 0 {
+		t.Fatal("Expected consistent model, got", issues, err)
+	}
+	// break the model in various ways
+	delete(model.StaticInfos, "nostin")
+	delete(model.TrackedPaths, "untracked")
+	tampered := model.StaticInfos["tampered"]
+	tampered.Content = "wrong"
+	model.StaticInfos["tampered"] = tampered
+	removeDir := root + "/" + shared.TINZENITEDIR + "/" + shared.REMOVEDIR
+	_ = os.MkdirAll(removeDir+"/incomplete", shared.FILEPERMISSIONMODE)
+	untrackedID := model.StaticInfos["untracked"].Identification
+	kinds := func(issues []Issue, repaired bool) map[IssueKind]int {
+		found := make(map[IssueKind]int)
+		for _, issue := range issues {
+			if issue.Repaired == repaired {
+				found[issue.Kind]++
+			}
+		}
+		return found
+	}
+	issues, _ = model.Check(false)
+	found := kinds(issues, false)
+	for _, kind := range []IssueKind{IssueMissingStaticInfo, IssueUntrackedStaticInfo, IssueContentMismatch, IssueBadRemoval, IssueIndexMismatch} {
+		if found[kind] == 0 {
+			t.Error("Expected issue", kind, "got", issues)
+		}
+	}
+	issues, err = model.Check(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the content mismatch isn't safe to repair
+	if unrepaired := kinds(issues, false); len(unrepaired) != 1 || unrepaired[IssueContentMismatch] != 1 {
+		t.Error("Expected only content mismatch to remain, got", issues)
+	}
+	if !model.IsTracked(root+"/nostin") || !model.IsTracked(root+"/untracked") {
+		t.Error("Expected entries to be repaired")
+	}
+	if id, _ := model.GetIdentification(shared.CreatePath(root, "untracked")); id != untrackedID {
+		t.Error("Expected identification to be kept, got", id)
+	}
+	issues, _ = model.Check(false)
+	if len(issues) != 1 || issues[0].Kind != IssueContentMismatch || issues[0].Path != "tampered" {
+		t.Error("Expected only content mismatch after repair, got", issues)
+	}
+	checkIndex(t, model)
+}
+
+func TestModel_History(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	model, _ := Create(root, PEERID, root+"/"+shared.STOREMODELDIR)
+	model.HistoryLimit = 2
+	file := root + "/history.txt"
+	_ = ioutil.WriteFile(file, []byte("first"), shared.FILEPERMISSIONMODE)
+	_ = model.Update()
+	path := shared.CreatePath(root, "history.txt")
+	original, _ := model.GetInfo(path)
+	// remote modifies overwrite the file
+	remoteModify := func(content string) {
+		remoteObj, _ := model.GetInfo(path)
+		remoteObj.Version = mergeVersions(remoteObj.Version, nil)
+		remoteObj.Version.Increase("otherpeer")
+		temp := root + "/" + shared.TINZENITEDIR + "/" + shared.TEMPDIR + "/" + remoteObj.Identification
+		_ = ioutil.WriteFile(temp, []byte(content), shared.FILEPERMISSIONMODE)
+		remoteObj.Content, _ = shared.ContentHash(temp)
+		err := model.ApplyModify(path, remoteObj)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	remoteModify("second")
+	entries, err := model.History(path)
+	if err != nil || len(entries) != 1 || entries[0].Content != original.Content {
+		t.Fatal("Expected original content in history, got", entries, err)
+	}
+	// a failed overwrite keeps nothing, so later edits in place can't change the history
+	failed, _ := model.GetInfo(path)
+	failed.Version = mergeVersions(failed.Version, nil)
+	failed.Version.Increase("otherpeer")
+	failed.Content = "missing"
+	if err = model.ApplyModify(path, failed); !errors.Is(err, ErrMissingUpdateFile) {
+		t.Error("Expected", ErrMissingUpdateFile, "got", err)
+	}
+	_ = ioutil.WriteFile(file, []byte("local edit"), shared.FILEPERMISSIONMODE)
+	if entries, _ = model.History(path); len(entries) != 1 {
+		t.Error("Expected failed overwrite not to be kept, got", entries)
+	}
+	_ = ioutil.WriteFile(file, []byte("second"), shared.FILEPERMISSIONMODE)
+	remoteModify("third")
+	remoteModify("fourth")
+	entries, _ = model.History(path)
+	if len(entries) != 2 {
+		t.Error("Expected history to be limited to 2, got", len(entries))
+	}
+	// restore is a local modify of the latest kept version
+	err = model.Restore(path, entries[1].Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(file); string(data) != "third" {
+		t.Error("Expected restored content, got", string(data))
+	}
+	restored, _ := model.GetInfo(path)
+	if restored.Version[PEERID] == 0 || restored.Content != entries[1].Content {
+		t.Error("Expected restore to be a local modify, got", restored)
+	}
+	err = model.Restore(path, original.Version)
+	if !errors.Is(err, ErrNoHistory) {
+		t.Error("Expected", ErrNoHistory, "got", err)
+	}
+	// damaged content must not be restored
+	entries, _ = model.History(path)
+	latest := entries[len(entries)-1]
+	_ = ioutil.WriteFile(model.historyPath(restored.Identification)+"/"+versionKey(latest.Version), []byte("damaged"), shared.FILEPERMISSIONMODE)
+	err = model.Restore(path, latest.Version)
+	if !errors.Is(err, ErrHistoryCorrupt) {
+		t.Error("Expected", ErrHistoryCorrupt, "got", err)
+	}
+	if data, _ := ioutil.ReadFile(file); string(data) != "third" {
+		t.Error("Expected file to be unchanged, got", string(data))
+	}
+}
+
+func TestModel_Trash(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	model, _ := Create(root, PEERID, root+"/"+shared.STOREMODELDIR)
+	model.HistoryLimit = 2
+	_ = os.Mkdir(root+"/trashed", shared.FILEPERMISSIONMODE)
+	_ = ioutil.WriteFile(root+"/trashed/inside", []byte("inside"), shared.FILEPERMISSIONMODE)
+	_ = model.Update()
+	path := shared.CreatePath(root, "trashed")
+	remoteObj, _ := model.GetInfo(path)
+	child, _ := model.GetInfo(shared.CreatePath(root, "trashed/inside"))
+	err := model.ApplyRemove(path, remoteObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := shared.ObjectExists(root + "/trashed"); exists || model.IsTracked(root+"/trashed/inside") {
+		t.Error("Expected remote removal to be applied")
+	}
+	entries, err := model.ListTrash()
+	if err != nil || len(entries) != 1 || entries[0].Path != "trashed" || entries[0].Identification != remoteObj.Identification {
+		t.Fatal("Expected removed directory in trash, got", entries, err)
+	}
+	// restoring creates fresh objects
+	err = model.RestoreTrash(entries[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(root + "/trashed/inside"); string(data) != "inside" {
+		t.Error("Expected content to be restored, got", string(data))
+	}
+	restored, err := model.GetInfo(path)
+	if err != nil || restored.Identification == remoteObj.Identification || !model.IsTracked(root+"/trashed/inside") {
+		t.Error("Expected restored objects to be created anew, got", restored, err)
+	}
+	restoredChild, err := model.GetInfo(shared.CreatePath(root, "trashed/inside"))
+	if err != nil || restoredChild.Identification == child.Identification {
+		t.Error("Expected restored children to be created anew, got", restoredChild, err)
+	}
+	if entries, _ = model.ListTrash(); len(entries) != 0 {
+		t.Error("Expected trash to be empty after restore, got", entries)
+	}
+	// purging only removes old enough entries
+	restored, _ = model.GetInfo(path)
+	_ = model.ApplyRemove(path, restored)
+	_ = model.PurgeTrash(time.Hour)
+	if entries, _ = model.ListTrash(); len(entries) != 1 {
+		t.Error("Expected recent entry to be kept, got", entries)
+	}
+	_ = model.PurgeTrash(0)
+	if entries, _ = model.ListTrash(); len(entries) != 0 {
+		t.Error("Expected trash to be empty after purge, got", entries)
+	}
+	// removed files are only kept in the trash
+	_ = ioutil.WriteFile(root+"/single", []byte("single"), shared.FILEPERMISSIONMODE)
+	_ = model.Update()
+	single, _ := model.GetInfo(shared.CreatePath(root, "single"))
+	_ = model.ApplyRemove(shared.CreatePath(root, "single"), single)
+	if kept, _ := model.readHistory(single.Identification); len(kept) != 0 {
+		t.Error("Expected trashed file not to be kept in the history as well, got", kept)
+	}
+	if entries, _ = model.ListTrash(); len(entries) != 1 {
+		t.Error("Expected removed file in trash, got", entries)
+	}
+	checkIndex(t, model)
+}
+
+func TestModel_Watch(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	// create model
+	model, _ := Create(root, PEERID, root+"/"+shared.STOREMODELDIR)
+	_ = model.Update()
+	watcher, err := model.Watch(10*time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subdir := makeTempDir(root, SUBDIR)
+	file := makeTempFile(subdir, FOUR)
+	// give the watcher time to apply the changes
+	time.Sleep(500 * time.Millisecond)
+	watcher.Close()
+	if !model.IsTracked(subdir) || !model.IsTracked(file) {
+		t.Error("Expected watcher to have tracked new objects")
+	}
+	// the ignore rules are refreshed per batch, not per path
+	generation := watcher.matcher.generation
+	for _, path := range []string{subdir, file, root + "/" + ONE} {
+		watcher.collect(make(map[string]bool), make(map[uint32]string), watchEvent{path: path})
+	}
+	if watcher.matcher.generation != generation {
+		t.Error("Expected matcher to be refreshed once per batch, got", watcher.matcher.generation-generation, "refreshes")
+	}
+	// after losing events full updates are run until watching is reliable again
+	var buffer bytes.Buffer
+	model.SetLogger(NewStdLogger(log.New(&buffer, "", 0), LogInfo))
+	watcher, _ = model.Watch(10*time.Millisecond, 50*time.Millisecond)
+	if watcher.backend == nil {
+		watcher.Close()
+		t.Skip("watching not supported")
+	}
+	watcher.overflow <- true
+	time.Sleep(500 * time.Millisecond)
+	watcher.Close()
+	if !strings.Contains(buffer.String(), "Watcher: watching reestablished.") {
+		t.Error("Expected watching to be reestablished, got", buffer.String())
+	}
+}
+
+func TestModel_Concurrent(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	model, _ := Create(root, PEERID, root+"/"+shared.STOREMODELDIR)
+	_ = model.Update()
+	updates := make(chan shared.UpdateMessage, 1000)
+	model.Register(updates)
+	go func() {
+		for range updates {
+		}
+	}()
+	// the watcher updates from its own go routine while we read and update too
+	watcher, err := model.Watch(time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			file := makeTempFile(root, FOUR)
+			_ = ioutil.WriteFile(file, []byte("concurrent"), shared.FILEPERMISSIONMODE)
+			_ = model.Update()
+		}
+	}()
+	running := true
+	for running {
+		select {
+		case <-done:
+			running = false
+		default:
+			model.Read()
+			model.IsTracked(root)
+			model.GetInfo(shared.CreatePathRoot(root))
+		}
+	}
+	watcher.Close()
+	_ = model.Update()
+	checkIndex(t, model)
+}
+
+func TestModel_Subscribe(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	model, _ := Create(root, PEERID, root+"/"+shared.STOREMODELDIR)
+	_ = model.Update()
+	_, err := model.Subscribe(Filter{}, 0, PolicyDropOldest)
+	if err != shared.ErrIllegalParameters {
+		t.Error("Expected", shared.ErrIllegalParameters, "got", err)
+	}
+	// filters
+	filtered, _ := model.Subscribe(Filter{Operations: []shared.Operation{shared.OpCreate}, Prefix: "dir"}, 10, PolicyBlock)
+	os.Mkdir(root+"/dir", shared.FILEPERMISSIONMODE)
+	_ = ioutil.WriteFile(root+"/dir/inside", []byte("inside"), shared.FILEPERMISSIONMODE)
+	_ = ioutil.WriteFile(root+"/dirty", []byte("outside"), shared.FILEPERMISSIONMODE)
+	_ = model.Update()
+	filtered.Close()
+	var paths []string
+	for event := range filtered.Events() {
+		paths = append(paths, event.Message.Object.Path)
+	}
+	if len(paths) != 2 || paths[0] != "dir" || paths[1] != "dir/inside" {
+		t.Error("Expected only creates within dir, got", paths)
+	}
+	message := func(path string) shared.UpdateMessage {
+		return shared.CreateUpdateMessage(shared.OpModify, shared.ObjectInfo{Path: path})
+	}
+	// dropping the oldest must be reported
+	dropping, _ := model.Subscribe(Filter{}, 2, PolicyDropOldest)
+	model.getBus().publish(message("a"))
+	model.getBus().publish(message("b"))
+	model.getBus().publish(message("c"))
+	first, second := <-dropping.Events(), <-dropping.Events()
+	if first.Message.Object.Path != "b" || second.Message.Object.Path != "c" || second.Dropped != 1 {
+		t.Error("Expected oldest to be dropped, got", first, second)
+	}
+	dropping.Close()
+	// coalescing replaces events of the same path
+	coalescing, _ := model.Subscribe(Filter{}, 2, PolicyCoalesce)
+	model.getBus().publish(message("a"))
+	model.getBus().publish(message("b"))
+	model.getBus().publish(message("a"))
+	first, second = <-coalescing.Events(), <-coalescing.Events()
+	if first.Message.Object.Path != "a" || second.Message.Object.Path != "b" {
+		t.Error("Expected events to be coalesced, got", first, second)
+	}
+	model.getBus().publish(message("c"))
+	if third := <-coalescing.Events(); third.Dropped != 1 {
+		t.Error("Expected coalesced event to be reported, got", third)
+	}
+	coalescing.Close()
+	// a blocked subscriber must not stall subscribing and closing
+	blocked, _ := model.Subscribe(Filter{}, 0, PolicyBlock)
+	published := make(chan bool)
+	go func() {
+		model.getBus().publish(message("a"))
+		close(published)
+	}()
+	// give publish time to block
+	time.Sleep(10 * time.Millisecond)
+	subscribed := make(chan bool)
+	go func() {
+		sub, _ := model.Subscribe(Filter{}, 1, PolicyDropOldest)
+		sub.Close()
+		close(subscribed)
+	}()
+	select {
+	case <-subscribed:
+	case <-time.After(time.Second):
+		t.Error("Expected subscribe and close not to wait for blocked subscriber")
+	}
+	blocked.Close()
+	<-published
+}
+
+func TestModel_SetLogger(t *testing.T) {
+	root := makeDefaultDirectory()
+	defer removeTemp(root)
+	model, _ := Create(root, PEERID, root+"/"+shared.STOREMODELDIR)
+	var buffer bytes.Buffer
+	model.SetLogger(NewStdLogger(log.New(&buffer, "", 0), LogWarn))
+	// debug messages are below the level
+	_, _ = model.GetInfo(shared.CreatePath(root, "missing"))
+	if buffer.Len() != 0 {
+		t.Error("Expected debug message to be filtered, got", buffer.String())
+	}
+	model.warn("test", Fields{Path: "a/b", Peer: "peer"})
+	if line := buffer.String(); line != "Model: WARNING: test path=a/b peer=peer\n" {
+		t.Error("Expected structured warning, got", line)
+	}
+	// nil silences the model
+	buffer.Reset()
+	model.SetLogger(nil)
+	model.error("test", Fields{})
+	if buffer.Len() != 0 {
+		t.Error("Expected no output, got", buffer.String())
+	}
+}
+
 // ------------------------- UTILITY FUNCTIONS ---------------------------------
 
 // PEERID is the peerid used for testing.
@@ -195,3 +1502,43 @@ removeTempDirectory removes everything contained within the path.
 func removeTemp(path string) {
 	os.RemoveAll(path)
 }
+
+/*
+checkIndex verifies that the identification index matches the staticinfos.
+*/
+func checkIndex(t *testing.T, model *Model) {
+	if len(model.identifications()) != len(model.StaticInfos) {
+		t.Error("Expected", len(model.StaticInfos), "indexed objects, got", len(model.identifications()))
+	}
+	for subpath, stin := range model.StaticInfos {
+		found, err := model.GetSubPath(stin.Identification)
+		if err != nil || found != subpath {
+			t.Error("Expected", stin.Identification, "to be found at", subpath, "got", found)
+		}
+	}
+}
+
+/*
+failingStorage is a MemoryStorage whose writes can be made to fail and whose
+appends can be made to fail after writing half of the data, as on a full disk.
+*/
+type failingStorage struct {
+	*MemoryStorage
+	failWrite  bool
+	failAppend bool
+}
+
+func (f *failingStorage) Write(name string, data []byte) error {
+	if f.failWrite {
+		return errors.New("disk full")
+	}
+	return f.MemoryStorage.Write(name, data)
+}
+
+func (f *failingStorage) Append(name string, data []byte) error {
+	if f.failAppend {
+		_ = f.MemoryStorage.Append(name, data[:len(data)/2])
+		return errors.New("disk full")
+	}
+	return f.MemoryStorage.Append(name, data)
+}
@@ -0,0 +1,319 @@
+package model
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+move describes the rename of an object from one sub path to another.
+*/
+type move struct {
+	from string
+	to   string
+}
+
+/*
+localMove applies a locally detected move to the model and notifies the update.
+The file on disk has already been moved, so only the model is re-keyed. Moves
+are sent as modifies of the new path keeping the Identification, see
+ApplyModify. As for any local change the version is increased.
+*/
+func (m *Model) localMove(from, to *shared.RelativePath) error {
+	stin, exists := m.StaticInfos[from.SubPath()]
+	if !exists {
+		m.warn("Move: stin is missing!", Fields{Path: from.SubPath(), Operation: "move"})
+		return ErrModelInconsistent
+	}
+	// move the entire subtree within the model, keeping all identities
+	m.rekey(from.SubPath(), to.SubPath())
+	stin.Version.Increase(m.SelfID)
+	m.setObject(to.SubPath(), stin)
+	localObj, err := m.getInfo(to)
+	if err != nil {
+		m.warn("Move: failed to retrieve ObjectInfo for notify!", Fields{Path: to.SubPath(), Operation: "move", Err: err})
+		return nil
+	}
+	m.notify(shared.OpModify, localObj)
+	return nil
+}
+
+/*
+moveObject renames the object on disk and moves the model entries of it and its
+subtree accordingly. Does not notify.
+*/
+func (m *Model) moveObject(from, to *shared.RelativePath) error {
+	// the target must not exist yet
+	if exists, _ := shared.ObjectExists(to.FullPath()); exists {
+		return shared.ErrConflict
+	}
+	err := os.Rename(from.FullPath(), to.FullPath())
+	if err != nil {
+		m.error("Move: failed to move!", Fields{Path: from.SubPath(), Operation: "move", Err: err})
+		return err
+	}
+	m.rekey(from.SubPath(), to.SubPath())
+	return nil
+}
+
+/*
+rekey moves all model entries of the object at from, including the entries of
+its children, to the sub path to. Nothing is rehashed.
+*/
+func (m *Model) rekey(from, to string) {
+	m.moveConflicts(from, to)
+	var subpaths []string
+	for subpath := range m.TrackedPaths {
+		if subpath == from || strings.HasPrefix(subpath, from+"/") {
+			subpaths = append(subpaths, subpath)
+		}
+	}
+	for subpath := range m.StaticInfos {
+		if _, tracked := m.TrackedPaths[subpath]; tracked {
+			continue
+		}
+		if subpath == from || strings.HasPrefix(subpath, from+"/") {
+			subpaths = append(subpaths, subpath)
+		}
+	}
+	for _, subpath := range subpaths {
+		stin, exists := m.StaticInfos[subpath]
+		m.removeObject(subpath)
+		// entries without stin are inconsistent anyway, so they are simply dropped
+		if exists {
+			m.setObject(to+strings.TrimPrefix(subpath, from), stin)
+		}
+	}
+}
+
+/*
+detectMoves pairs removed and created paths that are in truth the same object
+having been renamed or moved. Objects are paired by size and modtime and then
+verified by content hash. Directories are only paired if their complete subtree
+matches and contains at least one file, in which case the subtree is handled as
+a single move. Ambiguous candidates are never paired. Returns the moves and the
+remaining created and removed paths, all in sorted order.
+*/
+func (m *Model) detectMoves(created, removed []string, known digests) ([]move, []string, []string) {
+	relPath := shared.CreatePathRoot(m.RootPath)
+	usedCreated := make(map[string]bool)
+	usedRemoved := make(map[string]bool)
+	var moves []move
+	// directories first as each match consumes the complete subtree
+	removedDirs := make(map[string][]string)
+	for _, subpath := range removed {
+		stin, exists := m.StaticInfos[subpath]
+		if !movable(subpath) || !exists || !stin.Directory {
+			continue
+		}
+		signature := m.removedSignature(subpath, removed)
+		removedDirs[signature] = append(removedDirs[signature], subpath)
+	}
+	// no need to look at the created paths if nothing can match (initial scans)
+	if len(removedDirs) != 0 {
+		signatures := make(map[string]string)
+		createdDirs := make(map[string][]string)
+		for _, subpath := range created {
+			if !movable(subpath) {
+				continue
+			}
+			isDir, _ := shared.DirectoryExists(relPath.Apply(subpath).FullPath())
+			if !isDir {
+				continue
+			}
+			signature, err := createdSignature(relPath, subpath, created)
+			if err != nil {
+				continue
+			}
+			signatures[subpath] = signature
+			createdDirs[signature] = append(createdDirs[signature], subpath)
+		}
+		for _, subpath := range created {
+			signature, isDir := signatures[subpath]
+			if usedCreated[subpath] || !isDir {
+				continue
+			}
+			// only unique matches are safe
+			if len(createdDirs[signature]) != 1 || len(removedDirs[signature]) != 1 {
+				continue
+			}
+			origin := removedDirs[signature][0]
+			if usedRemoved[origin] || !m.sameSubtree(relPath, origin, subpath, removed, known) {
+				continue
+			}
+			moves = append(moves, move{from: origin, to: subpath})
+			markSubtree(usedRemoved, origin, removed)
+			markSubtree(usedCreated, subpath, created)
+		}
+	}
+	// then single files
+	removedFiles := make(map[string][]string)
+	for _, subpath := range removed {
+		stin, exists := m.StaticInfos[subpath]
+		if usedRemoved[subpath] || !movable(subpath) || !exists || stin.Directory {
+			continue
+		}
+		key := fileKey(stin.Size, stin.Modtime.UnixNano())
+		removedFiles[key] = append(removedFiles[key], subpath)
+	}
+	createdFiles := make(map[string][]string)
+	for _, subpath := range created {
+		// again skip the work if nothing can match
+		if len(removedFiles) == 0 {
+			break
+		}
+		if usedCreated[subpath] || !movable(subpath) {
+			continue
+		}
+		stat, err := os.Lstat(relPath.Apply(subpath).FullPath())
+		if err != nil || stat.IsDir() {
+			continue
+		}
+		key := fileKey(stat.Size(), stat.ModTime().UnixNano())
+		createdFiles[key] = append(createdFiles[key], subpath)
+	}
+	for key, targets := range createdFiles {
+		origins := removedFiles[key]
+		// only unique matches are safe
+		if len(targets) != 1 || len(origins) != 1 {
+			continue
+		}
+		hash, err := known.hash(relPath.Apply(targets[0]).FullPath())
+		if err != nil || hash != m.StaticInfos[origins[0]].Content {
+			continue
+		}
+		moves = append(moves, move{from: origins[0], to: targets[0]})
+		usedRemoved[origins[0]] = true
+		usedCreated[targets[0]] = true
+	}
+	// sort so that moves are applied parents first
+	sort.Sort(sortableMoves(moves))
+	return moves, filterUsed(created, usedCreated), filterUsed(removed, usedRemoved)
+}
+
+/*
+removedSignature builds a string describing the structure of the removed
+subtree of the given directory based on the model information.
+*/
+func (m *Model) removedSignature(dir string, removed []string) string {
+	var entries []string
+	for _, subpath := range withPrefix(removed, dir+"/") {
+		relative := strings.TrimPrefix(subpath, dir+"/")
+		stin := m.StaticInfos[subpath]
+		if stin.Directory {
+			entries = append(entries, relative+"/")
+		} else {
+			entries = append(entries, relative+":"+fileKey(stin.Size, stin.Modtime.UnixNano()))
+		}
+	}
+	return strings.Join(entries, "\n")
+}
+
+/*
+createdSignature builds a string describing the structure of the created
+subtree of the given directory based on the disk.
+*/
+func createdSignature(relPath *shared.RelativePath, dir string, created []string) (string, error) {
+	var entries []string
+	for _, subpath := range withPrefix(created, dir+"/") {
+		relative := strings.TrimPrefix(subpath, dir+"/")
+		stat, err := os.Lstat(relPath.Apply(subpath).FullPath())
+		if err != nil {
+			return "", err
+		}
+		if stat.IsDir() {
+			entries = append(entries, relative+"/")
+		} else {
+			entries = append(entries, relative+":"+fileKey(stat.Size(), stat.ModTime().UnixNano()))
+		}
+	}
+	return strings.Join(entries, "\n"), nil
+}
+
+/*
+sameSubtree verifies the content hashes of all files within the created
+directory against the model information of the removed directory. Subtrees
+without files are never the same: all empty directories look alike, so pairing
+them would move an unrelated directory on the peers.
+*/
+func (m *Model) sameSubtree(relPath *shared.RelativePath, origin, target string, removed []string, known digests) bool {
+	verified := 0
+	for _, subpath := range withPrefix(removed, origin+"/") {
+		stin := m.StaticInfos[subpath]
+		if stin.Directory {
+			continue
+		}
+		hash, err := known.hash(relPath.Apply(target + strings.TrimPrefix(subpath, origin)).FullPath())
+		if err != nil || hash != stin.Content {
+			return false
+		}
+		verified++
+	}
+	return verified > 0
+}
+
+/*
+movable returns true if move detection may be applied to the sub path. The root
+and the .tinzenite directory are never moved.
+*/
+func movable(subpath string) bool {
+	return subpath != "" && !strings.HasPrefix(subpath, shared.TINZENITEDIR)
+}
+
+/*
+fileKey builds the key used to find move candidates for files.
+*/
+func fileKey(size, modtime int64) string {
+	return strconv.FormatInt(size, 10) + ":" + strconv.FormatInt(modtime, 10)
+}
+
+/*
+markSubtree marks the directory and all paths within it as used.
+*/
+func markSubtree(used map[string]bool, dir string, list []string) {
+	used[dir] = true
+	for _, subpath := range withPrefix(list, dir+"/") {
+		used[subpath] = true
+	}
+}
+
+/*
+withPrefix returns the part of the sorted list that starts with the prefix.
+Since the list is sorted all these paths follow each other directly.
+*/
+func withPrefix(sorted []string, prefix string) []string {
+	start := sort.SearchStrings(sorted, prefix)
+	end := start
+	for end < len(sorted) && strings.HasPrefix(sorted[end], prefix) {
+		end++
+	}
+	return sorted[start:end]
+}
+
+/*
+filterUsed returns the list without the used paths, keeping the order.
+*/
+func filterUsed(list []string, used map[string]bool) []string {
+	var remaining []string
+	for _, subpath := range list {
+		if used[subpath] {
+			continue
+		}
+		remaining = append(remaining, subpath)
+	}
+	return remaining
+}
+
+/*
+sortableMoves sorts moves by their target path so that parents are always
+handled before their children.
+*/
+type sortableMoves []move
+
+func (s sortableMoves) Len() int           { return len(s) }
+func (s sortableMoves) Less(i, j int) bool { return s[i].to < s[j].to }
+func (s sortableMoves) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,213 @@
+package model
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+Plan lists the changes an update of the scope would apply, see Model.Plan. All
+lists are in the order the update applies them.
+*/
+type Plan struct {
+	// Scope is the full path of the planned update.
+	Scope    string
+	Creates  []PlanEntry
+	Moves    []PlanEntry
+	Modifies []PlanEntry
+	Removes  []PlanEntry
+}
+
+/*
+PlanEntry is a single planned change. For creates, moves and modifies the values
+describe the object on disk, for removes the object as known to the model.
+Identification is empty for creates, From is only set for moves. Content and
+Size are only set for files, Mode only for directories.
+*/
+type PlanEntry struct {
+	Path           string
+	From           string
+	Identification string
+	Directory      bool
+	Content        string
+	Size           int64
+	Mode           os.FileMode
+	Modtime        time.Time
+}
+
+/*
+IsEmpty returns true if the plan contains no changes.
+*/
+func (p *Plan) IsEmpty() bool {
+	return len(p.Creates)+len(p.Moves)+len(p.Modifies)+len(p.Removes) == 0
+}
+
+/*
+Plan returns the changes an update of the scope would apply without changing the
+model or sending any notifications. Scope is the FULL path as for PartialUpdate.
+The plan can be applied with ApplyPlan.
+*/
+func (m *Model) Plan(scope string) (*Plan, error) {
+	ctx := context.Background()
+	current, err := m.scan(ctx, scope)
+	if err != nil {
+		return nil, err
+	}
+	prepared, err := m.prepareDigests(ctx, current)
+	if err != nil {
+		return nil, err
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.plan(scope, current, prepared)
+}
+
+/*
+ApplyPlan applies a plan returned by Plan. If the disk or the model changed in a
+way that the plan no longer matches, nothing is applied and ErrPlanOutdated is
+returned. Files that haven't changed since planning are not hashed again.
+*/
+func (m *Model) ApplyPlan(plan *Plan) error {
+	if plan == nil {
+		return wrapError("plan", "", "", shared.ErrIllegalParameters)
+	}
+	ctx := context.Background()
+	current, err := m.scan(ctx, plan.Scope)
+	if err == nil {
+		err = m.update(ctx, plan.Scope, current, plan.digests(m.RootPath), plan)
+	}
+	return wrapError("plan", shared.CreatePathRoot(m.RootPath).Apply(plan.Scope).SubPath(), "", err)
+}
+
+/*
+plan is Plan without locking, using the known digests where still valid.
+*/
+func (m *Model) plan(scope string, current map[string]bool, known digests) (*Plan, error) {
+	if m.TrackedPaths == nil || m.StaticInfos == nil {
+		return nil, shared.ErrNilInternalState
+	}
+	// same steps as applyUpdate
+	created, modified, removed := m.compareMaps(scope, current)
+	var moves []move
+	moves, created, removed = m.detectMoves(created, removed, known)
+	relPath := shared.CreatePathRoot(m.RootPath)
+	plan := &Plan{Scope: scope}
+	for _, subpath := range created {
+		entry, err := m.diskEntry(relPath.Apply(subpath), known)
+		if err != nil {
+			return nil, err
+		}
+		plan.Creates = append(plan.Creates, entry)
+	}
+	for _, mv := range moves {
+		entry, err := m.diskEntry(relPath.Apply(mv.to), known)
+		if err != nil {
+			return nil, err
+		}
+		entry.From = mv.from
+		entry.Identification = m.StaticInfos[mv.from].Identification
+		plan.Moves = append(plan.Moves, entry)
+	}
+	for _, subpath := range modified {
+		path := relPath.Apply(subpath)
+		if !m.isModified(path, known) {
+			continue
+		}
+		entry, err := m.diskEntry(path, known)
+		if err != nil {
+			return nil, err
+		}
+		entry.Identification = m.StaticInfos[subpath].Identification
+		plan.Modifies = append(plan.Modifies, entry)
+	}
+	for _, subpath := range removed {
+		stin := m.StaticInfos[subpath]
+		plan.Removes = append(plan.Removes, PlanEntry{
+			Path:           subpath,
+			Identification: stin.Identification,
+			Directory:      stin.Directory,
+			Content:        stin.Content,
+			Size:           stin.Size,
+			Mode:           stin.Mode,
+			Modtime:        stin.Modtime})
+	}
+	return plan, nil
+}
+
+/*
+diskEntry describes the object on disk at path. Directories have no modtime as
+it changes with every child.
+*/
+func (m *Model) diskEntry(path *shared.RelativePath, known digests) (PlanEntry, error) {
+	stat, err := os.Lstat(path.FullPath())
+	if err != nil {
+		return PlanEntry{}, err
+	}
+	if stat.IsDir() {
+		return PlanEntry{Path: path.SubPath(), Directory: true, Mode: stat.Mode().Perm()}, nil
+	}
+	fileDigest, err := known.lookup(path.FullPath(), stat, false)
+	if err != nil {
+		return PlanEntry{}, err
+	}
+	return PlanEntry{
+		Path:    path.SubPath(),
+		Content: fileDigest.content,
+		Size:    stat.Size(),
+		Modtime: stat.ModTime()}, nil
+}
+
+/*
+digests returns the file hashes of the plan so that they can be reused when
+applying it. They are only used if the files are unchanged, see digests.lookup.
+*/
+func (p *Plan) digests(root string) digests {
+	known := make(digests)
+	for _, list := range [][]PlanEntry{p.Creates, p.Moves, p.Modifies} {
+		for _, entry := range list {
+			if entry.Directory {
+				continue
+			}
+			known[root+"/"+entry.Path] = digest{
+				size:    entry.Size,
+				modtime: entry.Modtime,
+				content: entry.Content}
+		}
+	}
+	return known
+}
+
+/*
+matches returns true if both plans contain the same changes.
+*/
+func (p *Plan) matches(other *Plan) bool {
+	return p.Scope == other.Scope &&
+		sameEntries(p.Creates, other.Creates) &&
+		sameEntries(p.Moves, other.Moves) &&
+		sameEntries(p.Modifies, other.Modifies) &&
+		sameEntries(p.Removes, other.Removes)
+}
+
+/*
+sameEntries compares two lists of plan entries.
+*/
+func sameEntries(a, b []PlanEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		x, y := a[i], b[i]
+		// modtimes must be compared via Equal
+		if !x.Modtime.Equal(y.Modtime) {
+			return false
+		}
+		x.Modtime, y.Modtime = time.Time{}, time.Time{}
+		if x != y {
+			return false
+		}
+	}
+	return true
+}
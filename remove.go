@@ -1,6 +1,7 @@
 package model
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
 	"time"
@@ -16,30 +17,30 @@ func (m *Model) localRemove(path *shared.RelativePath) error {
 	// get stin for notify
 	stin, exists := m.StaticInfos[path.SubPath()]
 	if !exists {
-		m.log("LocalRemove: stin is missing!")
+		m.warn("Remove: stin is missing!", Fields{Path: path.SubPath(), Operation: "remove"})
 		return shared.ErrIllegalFileState
 	}
 	// sanity check
-	if m.IsRemoved(stin.Identification) {
+	if m.isRemoved(stin.Identification) {
 		// shouldn't happen but let's be sure; warn at least
-		m.warn("LocalRemove: file removal already begun!")
+		m.warn("Remove: file removal already begun!", Fields{Path: path.SubPath(), Identification: stin.Identification, Operation: "remove"})
 	}
 	// direct remove (removes file/dir AND from m.Tracked and m.Static)
 	err := m.directRemove(path)
 	if err != nil {
-		m.log("LocalRemove: failed to directly remove file!")
+		m.error("Remove: failed to directly remove file!", Fields{Path: path.SubPath(), Identification: stin.Identification, Operation: "remove", Err: err})
 		return err
 	}
 	// write peers to check and own peer to done
-	err = m.UpdateRemovalDir(stin.Identification, m.SelfID)
+	err = m.updateRemovalDir(stin.Identification, m.SelfID)
 	if err != nil {
-		m.log("failed to update removal dir for", stin.Identification)
+		m.error("Remove: failed to update removal dir!", Fields{Path: path.SubPath(), Identification: stin.Identification, Operation: "remove", Err: err})
 		return err
 	}
 	// update removal dir here so that creations etc are sent before notify below!
 	err = m.updateLocal(m.RootPath + "/" + shared.TINZENITEDIR + "/" + shared.REMOVEDIR + "/" + stin.Identification)
 	if err != nil {
-		m.warn("partial update on local remove failed!")
+		m.warn("Remove: partial update failed!", Fields{Identification: stin.Identification, Operation: "remove", Err: err})
 		// but continue on because the changes will be synchronized later then anyway
 	}
 	// update version
@@ -57,7 +58,8 @@ func (m *Model) localRemove(path *shared.RelativePath) error {
 }
 
 /*
-remoteRemove handles a remote call of remove.
+remoteRemove handles a remote call of remove. The object is not deleted but
+moved to the trash, see ListTrash.
 */
 func (m *Model) remoteRemove(path *shared.RelativePath, remoteObject *shared.ObjectInfo) error {
 	// sanity check
@@ -65,26 +67,26 @@ func (m *Model) remoteRemove(path *shared.RelativePath, remoteObject *shared.Obj
 		return shared.ErrIllegalParameters
 	}
 	// get state information
-	localFileExists := m.IsTracked(path.FullPath())
-	removalExists := m.IsRemoved(remoteObject.Identification)
+	localFileExists := m.isTracked(path.FullPath())
+	removalExists := m.isRemoved(remoteObject.Identification)
 	// if still exists locally remove it
 	if localFileExists {
-		// remove file (removedir should already exist, so nothing else to do)
-		err := m.directRemove(path)
+		// keep the object in the trash only, not in the history as well (removedir should already exist)
+		err := m.trashObject(path)
 		if err != nil {
-			m.log("couldn't remove file", path.FullPath())
+			m.error("Remove: couldn't remove file!", Fields{Path: path.SubPath(), Identification: remoteObject.Identification, Operation: "remove", Err: err})
 			return err
 		}
 	}
 	// warn if remove dir didn't exist yet
 	if !removalExists {
 		// we'll create it anyway if it doesn't exist, so all ok but warn
-		m.warn("remote file removed but removedir didn't yet exist!")
+		m.warn("Remove: remote file removed but removedir didn't yet exist!", Fields{Path: path.SubPath(), Identification: remoteObject.Identification, Operation: "remove"})
 	}
 	// since remote removal --> write own peer to done
-	err := m.UpdateRemovalDir(remoteObject.Identification, m.SelfID)
+	err := m.updateRemovalDir(remoteObject.Identification, m.SelfID)
 	if err != nil {
-		m.log("updating removal dir failed!")
+		m.error("Remove: updating removal dir failed!", Fields{Identification: remoteObject.Identification, Operation: "remove", Err: err})
 		return err
 	}
 	// send notify (reuse remoteObject)
@@ -100,13 +102,13 @@ func (m *Model) checkRemove() error {
 	removeDir := m.RootPath + "/" + shared.TINZENITEDIR + "/" + shared.REMOVEDIR
 	allRemovals, err := ioutil.ReadDir(removeDir)
 	if err != nil {
-		m.log("reading all removals failed")
+		m.error("Remove: reading all removals failed!", Fields{Operation: "remove", Err: err})
 		return err
 	}
 	// check for each removal
 	for _, stat := range allRemovals {
 		// update removal stats and write own peer to them
-		err = m.UpdateRemovalDir(stat.Name(), m.SelfID)
+		err = m.updateRemovalDir(stat.Name(), m.SelfID)
 		if err != nil {
 			return err
 		}
@@ -114,26 +116,26 @@ func (m *Model) checkRemove() error {
 		err := m.completeTrackedRemoval(stat.Name())
 		if err != nil {
 			// notify of error but don't stop, rest can still be checked
-			m.log("completeTrackedRemoval:", err.Error())
+			m.warn("Remove: completing removal failed!", Fields{Identification: stat.Name(), Operation: "remove", Err: err})
 		}
 		// warn of possible orphans
 		if time.Since(stat.ModTime()) > removalTimeout {
-			m.warn("Removal may be orphaned! ", stat.Name())
+			m.warn("Remove: removal may be orphaned!", Fields{Identification: stat.Name(), Operation: "remove"})
 			/*TODO this may be called even if it has just been removed... do better logic!
 			Also: is there something we can do in this case?*/
 		}
 		// warn of possibly unapplied removals:
-		subPath, err := m.GetSubPath(stat.Name())
+		subPath, err := m.getSubPath(stat.Name())
 		// if err just skip the check (can happen if the file has been removed, so ok)
-		if err == nil && m.IsTracked(m.RootPath+"/"+subPath) {
-			m.warn("Removal may be unapplied!", subPath)
+		if err == nil && m.isTracked(m.RootPath+"/"+subPath) {
+			m.warn("Remove: removal may be unapplied!", Fields{Path: subPath, Identification: stat.Name(), Operation: "remove"})
 		}
 	}
 	// also remove old local remove notifies:
 	localDir := m.RootPath + "/" + shared.TINZENITEDIR + "/" + shared.LOCALDIR + "/" + shared.REMOVESTOREDIR
 	allLocals, err := ioutil.ReadDir(localDir)
 	if err != nil {
-		m.log("reading of local remove notifies failed!")
+		m.error("Remove: reading local remove notifies failed!", Fields{Operation: "remove", Err: err})
 		return err
 	}
 	for _, stat := range allLocals {
@@ -141,7 +143,7 @@ func (m *Model) checkRemove() error {
 			// remove notify
 			err := os.Remove(localDir + "/" + stat.Name())
 			if err != nil {
-				m.warn("Failed to remove notify object:", err.Error())
+				m.warn("Remove: failed to remove notify object!", Fields{Identification: stat.Name(), Operation: "remove", Err: err})
 			}
 		}
 	}
@@ -160,7 +162,7 @@ func (m *Model) completeTrackedRemoval(identification string) error {
 	// read all peers to check for
 	allCheck, err := ioutil.ReadDir(objRemovePath + "/" + shared.REMOVECHECKDIR)
 	if err != nil {
-		m.log("Failed reading check peer list!")
+		m.error("Remove: failed reading check peer list!", Fields{Identification: identification, Operation: "remove", Err: err})
 		return err
 	}
 	// Test whether we can remove it. This means all peers must have been written
@@ -172,7 +174,7 @@ func (m *Model) completeTrackedRemoval(identification string) error {
 		exists, err := shared.FileExists(checkPath)
 		if err != nil {
 			// if any error we are done, so break
-			m.warn("Failed checking for peer:", err.Error())
+			m.warn("Remove: failed checking for peer!", Fields{Identification: identification, Operation: "remove", Peer: peerStat.Name(), Err: err})
 			complete = false
 			break
 		}
@@ -187,13 +189,13 @@ func (m *Model) completeTrackedRemoval(identification string) error {
 		// make local note of removal instead of tracked one so that we can remove it
 		err := m.makeLocalRemove(identification)
 		if err != nil {
-			m.log("failed to write local remove note, will not complete removal!")
+			m.error("Remove: failed to write local remove note, will not complete removal!", Fields{Identification: identification, Operation: "remove", Err: err})
 			return err
 		}
 		// HARD delete the entire dir: all peers should do the same (soft delete would make removal recursive)
 		err = m.directRemove(shared.CreatePathRoot(m.RootPath).Apply(objRemovePath))
 		if err != nil {
-			m.log("Failed to direct remove!")
+			m.error("Remove: failed to direct remove!", Fields{Identification: identification, Operation: "remove", Err: err})
 			return err
 		}
 		// note that other peers may not HARD delete it yet, but the isLocalRemoved check ensures that the dir isn't reintroduced
@@ -206,17 +208,26 @@ UpdateRemovalDir is an internal function that writes all known trusted peers to
 check. Also, if given, it will add the given peer to the REMOVEDONEDIR.
 */
 func (m *Model) UpdateRemovalDir(objIdentification, peerIdentification string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.updateRemovalDir(objIdentification, peerIdentification)
+}
+
+/*
+updateRemovalDir is UpdateRemovalDir without locking.
+*/
+func (m *Model) updateRemovalDir(objIdentification, peerIdentification string) error {
 	removeDirectory := m.RootPath + "/" + shared.TINZENITEDIR + "/" + shared.REMOVEDIR + "/" + objIdentification
 	// make directories if don't exist
 	err := shared.MakeDirectories(removeDirectory, shared.REMOVECHECKDIR, shared.REMOVEDONEDIR)
 	if err != nil {
-		m.log("making removedir error!", err.Error())
+		m.error("Remove: making removedir failed!", Fields{Identification: objIdentification, Operation: "remove", Err: err})
 		return err
 	}
 	// fetch peer objects from disk
 	peers, err := shared.LoadPeers(m.RootPath)
 	if err != nil {
-		m.log("Failed to read peers")
+		m.error("Remove: failed to read peers!", Fields{Identification: objIdentification, Operation: "remove", Err: err})
 		return err
 	}
 	// write peer list to check which must all be notified of removal
@@ -232,7 +243,7 @@ func (m *Model) UpdateRemovalDir(objIdentification, peerIdentification string) e
 		}
 		err = ioutil.WriteFile(path, []byte(""), shared.FILEPERMISSIONMODE)
 		if err != nil {
-			m.log("Couldn't write peer file", peer.Name, "to", shared.REMOVECHECKDIR, "!", err.Error())
+			m.error("Remove: couldn't write peer file to "+shared.REMOVECHECKDIR+"!", Fields{Identification: objIdentification, Operation: "remove", Peer: peer.Name, Err: err})
 			return err
 		}
 	}
@@ -244,7 +255,7 @@ func (m *Model) UpdateRemovalDir(objIdentification, peerIdentification string) e
 			// write own peer file also to done dir as removal already applied locally
 			err = ioutil.WriteFile(path, []byte(""), shared.FILEPERMISSIONMODE)
 			if err != nil {
-				m.log("Couldn't write peer file to", shared.REMOVEDONEDIR, "!", err.Error())
+				m.error("Remove: couldn't write peer file to "+shared.REMOVEDONEDIR+"!", Fields{Identification: objIdentification, Operation: "remove", Peer: peerIdentification, Err: err})
 				return err
 			}
 		}
@@ -264,9 +275,9 @@ func (m *Model) directRemove(path *shared.RelativePath) error {
 	// if directory also directRemove all children
 	if dir {
 		// get all candidates
-		children, err := m.partialPopulateMap(path.FullPath())
+		children, err := m.partialPopulateMap(context.Background(), path.FullPath())
 		if err != nil {
-			m.warn("directRemove: failed to retrieve children of directory!")
+			m.warn("Remove: failed to retrieve children of directory!", Fields{Path: path.SubPath(), Operation: "remove", Err: err})
 			return err
 		}
 		// for each recursively call directRemove
@@ -286,13 +297,13 @@ func (m *Model) directRemove(path *shared.RelativePath) error {
 	if exists, _ := shared.ObjectExists(path.FullPath()); exists {
 		err := os.RemoveAll(path.FullPath())
 		if err != nil {
-			m.log("directRemove failed to remove the file itself!")
+			m.error("Remove: failed to remove the file itself!", Fields{Path: path.SubPath(), Operation: "remove", Err: err})
 			return err
 		}
 	}
 	// remove from model in any case (if no error)
-	delete(m.TrackedPaths, path.SubPath())
-	delete(m.StaticInfos, path.SubPath())
+	m.removeObject(path.SubPath())
+	m.dropConflicts(path.SubPath())
 	return nil
 }
 
@@ -301,6 +312,15 @@ IsRemoved checks whether a file is due for deletion or whether it has already
 been locally removed completely.
 */
 func (m *Model) IsRemoved(identification string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.isRemoved(identification)
+}
+
+/*
+isRemoved is IsRemoved without locking.
+*/
+func (m *Model) isRemoved(identification string) bool {
 	path := m.RootPath + "/" + shared.TINZENITEDIR + "/" + shared.REMOVEDIR + "/" + identification
 	exists, _ := shared.DirectoryExists(path)
 	return exists || m.isLocalRemoved(identification)
@@ -3,6 +3,7 @@ package model
 import (
 	"encoding/json"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/tinzenite/shared"
@@ -11,21 +12,28 @@ import (
 /*
 staticinfo stores all information that Tinzenite must keep between calls to
 m.Update(). This includes the object ID and version for reapplication, plus
-the content hash if required for file content changes detection.
+the content hash if required for file content changes detection. Directories
+store their permissions as Mode instead, which is their only modifiable metadata
+and is sent to other peers as their content, see directoryContent. Files
+optionally store their content defined block list.
 */
 type staticinfo struct {
 	Identification string
 	Directory      bool
 	Content        string
+	Size           int64
 	Modtime        time.Time
+	Mode           os.FileMode
 	Version        shared.Version
+	Blocks         []Block `json:",omitempty"`
 }
 
 /*
 createStaticInfo for the given file at the path with all values filled
-accordingly.
+accordingly. If chunked the block list of files is computed too. Known digests
+are used instead of hashing again where still valid.
 */
-func createStaticInfo(path, selfpeerid string) (*staticinfo, error) {
+func createStaticInfo(path, selfpeerid string, chunked bool, known digests) (*staticinfo, error) {
 	// fetch all values we'll need to store
 	id, err := shared.NewIdentifier()
 	if err != nil {
@@ -36,47 +44,102 @@ func createStaticInfo(path, selfpeerid string) (*staticinfo, error) {
 		return nil, err
 	}
 	hash := ""
-	if !stat.IsDir() {
-		hash, err = shared.ContentHash(path)
+	var size int64
+	var mode os.FileMode
+	var blocks []Block
+	if stat.IsDir() {
+		mode = stat.Mode().Perm()
+	} else {
+		fileDigest, err := known.lookup(path, stat, chunked)
 		if err != nil {
 			return nil, err
 		}
+		hash = fileDigest.content
+		blocks = fileDigest.blocks
+		size = stat.Size()
 	}
 	return &staticinfo{
 		Identification: id,
 		Version:        shared.CreateVersion(),
 		Directory:      stat.IsDir(),
 		Content:        hash,
+		Size:           size,
+		Mode:           mode,
+		Blocks:         blocks,
 		Modtime:        stat.ModTime()}, nil
 }
 
 /*
-UpdateFromDisk updates the hash and modtime to match the file on disk.
+UpdateFromDisk updates the hash, size, mode, and modtime to match the object on
+disk. If chunked the block list is updated too, otherwise it is dropped. Known
+digests are used instead of hashing again where still valid.
 */
-func (s *staticinfo) updateFromDisk(path string) error {
-	if !s.Directory {
-		hash, err := shared.ContentHash(path)
-		if err != nil {
-			return err
-		}
-		s.Content = hash
-	}
+func (s *staticinfo) updateFromDisk(path string, chunked bool, known digests) error {
 	stat, err := os.Lstat(path)
 	if err != nil {
 		return err
 	}
+	if s.Directory {
+		s.Mode = stat.Mode().Perm()
+	} else {
+		fileDigest, err := known.lookup(path, stat, chunked)
+		if err != nil {
+			return err
+		}
+		s.Content = fileDigest.content
+		s.Blocks = fileDigest.blocks
+		s.Size = stat.Size()
+	}
 	s.Modtime = stat.ModTime()
 	return nil
 }
 
 /*
-ApplyObjectInfo to staticinfo object.
+ApplyObjectInfo to staticinfo object. The permissions of directories are read
+from disk instead.
 */
 func (s *staticinfo) applyObjectInfo(obj *shared.ObjectInfo) {
 	s.Identification = obj.Identification
 	s.Version = obj.Version
 	s.Directory = obj.Directory
-	s.Content = obj.Content
+	if !obj.Directory {
+		s.Content = obj.Content
+	}
+}
+
+/*
+content returns the content as sent to other peers: the hash for files and the
+permissions for directories.
+*/
+func (s *staticinfo) content() string {
+	if s.Directory {
+		return directoryContent(s.Mode)
+	}
+	return s.Content
+}
+
+/*
+directoryContent encodes the permissions of a directory as content. Directories
+have no content otherwise, so this way the permissions are sent to other peers
+without changing shared.ObjectInfo.
+*/
+func directoryContent(mode os.FileMode) string {
+	return "0" + strconv.FormatUint(uint64(mode.Perm()), 8)
+}
+
+/*
+applyDirectoryContent sets the permissions sent as content of the directory at
+path. Peers that don't send permissions send an empty content, which is ignored.
+*/
+func applyDirectoryContent(path, content string) error {
+	if content == "" {
+		return nil
+	}
+	mode, err := strconv.ParseUint(content, 8, 32)
+	if err != nil || os.FileMode(mode) != os.FileMode(mode).Perm() {
+		return ErrFilter
+	}
+	return os.Chmod(path, os.FileMode(mode))
 }
 
 func (s *staticinfo) String() string {
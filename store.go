@@ -0,0 +1,259 @@
+package model
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+Storage persists the model. Names are plain file names like shared.MODELJSON.
+Reading a missing name must return an error for which os.IsNotExist is true.
+*/
+type Storage interface {
+	// Read returns the complete content stored under name.
+	Read(name string) ([]byte, error)
+	// Write replaces the content of name atomically: after a crash it is either the old or the new content.
+	Write(name string, data []byte) error
+	// Append adds the data to the end of name durably, creating it if required.
+	Append(name string, data []byte) error
+	// Rename moves the content of from to to, replacing to.
+	Rename(from, to string) error
+	// Remove deletes name.
+	Remove(name string) error
+}
+
+/*
+Suffixes of the files written next to the model. The temporary file holds new
+content until it is complete, the backup the previous generation of the model.
+*/
+const (
+	tempSuffix   = ".tmp"
+	backupSuffix = ".bak"
+)
+
+/*
+FileStorage stores the model as files within a directory on disk.
+*/
+type FileStorage struct {
+	dir string
+}
+
+/*
+NewFileStorage returns a storage writing to the given directory.
+*/
+func NewFileStorage(dir string) *FileStorage {
+	return &FileStorage{dir: dir}
+}
+
+/*
+Read the content of the file.
+*/
+func (f *FileStorage) Read(name string) ([]byte, error) {
+	return ioutil.ReadFile(f.dir + "/" + name)
+}
+
+/*
+Write the data to the file so that the file is always either the old or the
+complete new version, even on crashes.
+*/
+func (f *FileStorage) Write(name string, data []byte) error {
+	path := f.dir + "/" + name
+	tempPath := path + tempSuffix
+	err := writeSynced(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, data)
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	err = os.Rename(tempPath, path)
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return syncDirectory(f.dir)
+}
+
+/*
+Append the data to the file.
+*/
+func (f *FileStorage) Append(name string, data []byte) error {
+	return writeSynced(f.dir+"/"+name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, data)
+}
+
+/*
+Rename the file.
+*/
+func (f *FileStorage) Rename(from, to string) error {
+	err := os.Rename(f.dir+"/"+from, f.dir+"/"+to)
+	if err != nil {
+		return err
+	}
+	return syncDirectory(f.dir)
+}
+
+/*
+Remove the file.
+*/
+func (f *FileStorage) Remove(name string) error {
+	return os.Remove(f.dir + "/" + name)
+}
+
+/*
+MemoryStorage keeps the model in memory only. Useful for tests and for embedding
+applications that copy the content to their own store.
+*/
+type MemoryStorage struct {
+	mutex sync.Mutex
+	files map[string][]byte
+}
+
+/*
+NewMemoryStorage returns an empty in memory storage.
+*/
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{files: make(map[string][]byte)}
+}
+
+/*
+Read returns a copy of the content.
+*/
+func (s *MemoryStorage) Read(name string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, exists := s.files[name]
+	if !exists {
+		return nil, notExist(name)
+	}
+	return append([]byte(nil), data...), nil
+}
+
+/*
+Write replaces the content.
+*/
+func (s *MemoryStorage) Write(name string, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.files[name] = append([]byte(nil), data...)
+	return nil
+}
+
+/*
+Append adds to the content.
+*/
+func (s *MemoryStorage) Append(name string, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.files[name] = append(s.files[name], data...)
+	return nil
+}
+
+/*
+Rename moves the content.
+*/
+func (s *MemoryStorage) Rename(from, to string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, exists := s.files[from]
+	if !exists {
+		return notExist(from)
+	}
+	delete(s.files, from)
+	s.files[to] = data
+	return nil
+}
+
+/*
+Remove deletes the content.
+*/
+func (s *MemoryStorage) Remove(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, exists := s.files[name]; !exists {
+		return notExist(name)
+	}
+	delete(s.files, name)
+	return nil
+}
+
+/*
+Names returns the sorted names of all stored contents.
+*/
+func (s *MemoryStorage) Names() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var names []string
+	for name := range s.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+readFallback reads name from the storage and passes its content to decode. If
+it is missing or can not be decoded the backup is used instead, in which case
+true is returned. If both fail the error of the primary is returned.
+*/
+func readFallback(storage Storage, name string, decode func(data []byte) error) (bool, error) {
+	data, err := storage.Read(name)
+	if err == nil {
+		err = decode(data)
+		if err == nil {
+			return false, nil
+		}
+	}
+	// a model of a newer version isn't corrupt, so the backup must not replace it
+	if errors.Is(err, ErrIncompatibleModel) {
+		return false, err
+	}
+	backup, backupErr := storage.Read(name + backupSuffix)
+	if backupErr != nil || decode(backup) != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+/*
+writeSynced writes the data to the file opened with the given flags and flushes
+it to disk.
+*/
+func writeSynced(path string, flags int, data []byte) error {
+	file, err := os.OpenFile(path, flags, shared.FILEPERMISSIONMODE)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		// must be on disk before any rename, otherwise the rename may survive a crash without the data
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+/*
+notExist returns the error for a missing name, matching os.IsNotExist.
+*/
+func notExist(name string) error {
+	return &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+}
+
+/*
+syncDirectory flushes the directory entries so that renames within it are
+durable.
+*/
+func syncDirectory(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
@@ -0,0 +1,252 @@
+package model
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+trashDir is the directory within LOCALDIR that keeps remotely removed objects
+until they are purged.
+*/
+const trashDir = "trash"
+
+/*
+TrashEntry is an object that was removed by a peer and kept in the trash. ID
+names the entry within the trash, the other values describe the object as it
+was known when it was removed. Children of a directory are kept with it but have
+no entries of their own.
+*/
+type TrashEntry struct {
+	ID             string
+	Path           string
+	Identification string
+	Directory      bool
+	Content        string
+	Size           int64
+	Version        shared.Version
+	Removed        time.Time
+}
+
+/*
+ListTrash returns all objects in the trash, oldest removal first.
+*/
+func (m *Model) ListTrash() ([]TrashEntry, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.readTrash()
+}
+
+/*
+RestoreTrash moves the object of the trash entry back to its original path. It is
+applied as a fresh local create, so the object and all its children receive new
+identifications and are sent to all peers. The old identifications stay removed
+as all peers already applied their removal. Fails with shared.ErrConflict if the
+path is taken meanwhile.
+*/
+func (m *Model) RestoreTrash(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	entry, err := m.readTrashEntry(id)
+	if err != nil {
+		return wrapError("restore", "", "", err)
+	}
+	return wrapError("restore", entry.Path, entry.Identification, m.restoreTrash(entry))
+}
+
+/*
+PurgeTrash permanently deletes all objects that have been in the trash for
+longer than the given age. An age of zero empties the trash.
+*/
+func (m *Model) PurgeTrash(age time.Duration) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	dir := m.trashPath()
+	entries, err := m.readTrash()
+	if err != nil {
+		return err
+	}
+	known := make(map[string]bool)
+	for _, entry := range entries {
+		if time.Since(entry.Removed) < age {
+			known[entry.ID] = true
+			continue
+		}
+		// metadata first so that the entry is never listed without content
+		err = os.Remove(dir + "/" + entry.ID + ".json")
+		if err != nil {
+			return err
+		}
+		err = os.RemoveAll(dir + "/" + entry.ID)
+		if err != nil {
+			return err
+		}
+	}
+	// content without metadata is left over from a crash while trashing
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(file.Name(), ".json")
+		if !known[name] {
+			err = os.RemoveAll(dir + "/" + file.Name())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+trashObject moves the object at path, including all its children, into the
+trash and removes it from the model. Objects that don't exist on disk anymore
+are only removed from the model.
+*/
+func (m *Model) trashObject(path *shared.RelativePath) error {
+	if exists, _ := shared.ObjectExists(path.FullPath()); !exists {
+		return m.directRemove(path)
+	}
+	id, err := shared.NewIdentifier()
+	if err != nil {
+		return err
+	}
+	dir := m.trashPath()
+	err = os.MkdirAll(dir, shared.FILEPERMISSIONMODE)
+	if err != nil {
+		return err
+	}
+	stin := m.StaticInfos[path.SubPath()]
+	data, err := json.Marshal(TrashEntry{
+		ID:             id,
+		Path:           path.SubPath(),
+		Identification: stin.Identification,
+		Directory:      stin.Directory,
+		Content:        stin.Content,
+		Size:           stin.Size,
+		Version:        stin.Version,
+		Removed:        time.Now()})
+	if err != nil {
+		return err
+	}
+	// content first: without metadata it is invisible and purged eventually
+	err = os.Rename(path.FullPath(), dir+"/"+id)
+	if err != nil {
+		return err
+	}
+	err = writeSynced(dir+"/"+id+".json", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, data)
+	if err != nil {
+		return err
+	}
+	// remove the subtree from the model
+	m.dropConflicts(path.SubPath())
+	prefix := path.SubPath() + "/"
+	for subpath := range m.TrackedPaths {
+		if subpath == path.SubPath() || strings.HasPrefix(subpath, prefix) {
+			m.removeObject(subpath)
+		}
+	}
+	for subpath := range m.StaticInfos {
+		if subpath == path.SubPath() || strings.HasPrefix(subpath, prefix) {
+			m.removeObject(subpath)
+		}
+	}
+	return nil
+}
+
+/*
+restoreTrash moves the object of the entry back and applies it as local create.
+*/
+func (m *Model) restoreTrash(entry TrashEntry) error {
+	target := m.RootPath + "/" + entry.Path
+	if exists, _ := shared.ObjectExists(target); exists {
+		return shared.ErrConflict
+	}
+	// parents may have been removed as well
+	err := os.MkdirAll(filepath.Dir(target), shared.FILEPERMISSIONMODE)
+	if err != nil {
+		return err
+	}
+	dir := m.trashPath()
+	err = os.Rename(dir+"/"+entry.ID, target)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(dir + "/" + entry.ID + ".json")
+	if err != nil {
+		m.warn("Trash: failed to remove metadata of restored entry!", Fields{Path: entry.Path, Identification: entry.Identification, Operation: "restore", Err: err})
+	}
+	// creates the object and any recreated parents with new identifications
+	err = m.updateLocal(target)
+	if err != nil {
+		return err
+	}
+	return m.persist()
+}
+
+/*
+readTrash returns all entries of the trash, oldest removal first.
+*/
+func (m *Model) readTrash() ([]TrashEntry, error) {
+	files, err := ioutil.ReadDir(m.trashPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var entries []TrashEntry
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		entry, err := m.readTrashEntry(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			m.warn("Trash: ignoring corrupt entry!", Fields{Path: file.Name(), Operation: "trash", Err: err})
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Removed.Before(entries[j].Removed)
+	})
+	return entries, nil
+}
+
+/*
+readTrashEntry reads the metadata of the trash entry.
+*/
+func (m *Model) readTrashEntry(id string) (TrashEntry, error) {
+	// ids are plain names, never paths
+	if id == "" || strings.ContainsAny(id, "/\\") || id == "." || id == ".." {
+		return TrashEntry{}, shared.ErrIllegalParameters
+	}
+	data, err := ioutil.ReadFile(m.trashPath() + "/" + id + ".json")
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	var entry TrashEntry
+	err = json.Unmarshal(data, &entry)
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	return entry, nil
+}
+
+/*
+trashPath returns the directory of the trash.
+*/
+func (m *Model) trashPath() string {
+	return m.RootPath + "/" + shared.TINZENITEDIR + "/" + shared.LOCALDIR + "/" + trashDir
+}
@@ -0,0 +1,307 @@
+package model
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tinzenite/shared"
+)
+
+/*
+Watcher keeps a model up to date by watching the directory for changes. Bursts of
+changes are collected until nothing changed for the delay and are then applied
+with as few calls to PartialUpdate as possible. If the directory can not be
+watched completely the watcher falls back to a full update every interval. The
+same happens after events have been lost, until a complete interval passed
+without losing events again.
+NOTE: the watcher updates the model from its own go routine.
+*/
+type Watcher struct {
+	model    *Model
+	delay    time.Duration
+	interval time.Duration
+	backend  watchBackend
+	matcher  *Matcher
+	events   chan watchEvent
+	overflow chan bool
+	stop     chan bool
+	done     chan bool
+}
+
+/*
+watchEvent is a single change reported by the backend. Moves are reported as two
+events sharing the same cookie.
+*/
+type watchEvent struct {
+	path      string
+	directory bool
+	movedFrom bool
+	cookie    uint32
+}
+
+/*
+watchBackend is the platform specific part that actually watches directories.
+Events are written to the events channel, lost events are signaled via the
+overflow channel.
+*/
+type watchBackend interface {
+	add(path string) error
+	close() error
+}
+
+/*
+Watch starts a watcher for the model. Changes are applied once no further change
+happened for the delay. Interval defines how often the complete model is updated
+should watching fail.
+*/
+func (m *Model) Watch(delay, interval time.Duration) (*Watcher, error) {
+	if delay <= 0 || interval <= 0 {
+		return nil, shared.ErrIllegalParameters
+	}
+	w := &Watcher{
+		model:    m,
+		delay:    delay,
+		interval: interval,
+		events:   make(chan watchEvent, 1024),
+		overflow: make(chan bool, 1),
+		stop:     make(chan bool),
+		done:     make(chan bool)}
+	w.refresh()
+	backend, err := newWatchBackend(w.events, w.overflow)
+	if err != nil {
+		m.warn("Watch: can not watch directory, falling back to periodic updates!", Fields{Operation: "watch", Err: err})
+	} else {
+		w.backend = backend
+		err = w.addRecursive(m.RootPath)
+		if err != nil {
+			w.fallback(err)
+		}
+	}
+	go w.run()
+	return w, nil
+}
+
+/*
+Close stops the watcher. Any pending changes are discarded, they will be picked
+up by the next update.
+*/
+func (w *Watcher) Close() error {
+	close(w.stop)
+	<-w.done
+	if w.backend != nil {
+		return w.backend.close()
+	}
+	return nil
+}
+
+/*
+run is the main loop of the watcher.
+*/
+func (w *Watcher) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	scopes := make(map[string]bool)
+	moves := make(map[uint32]string)
+	// quiet fires once no event happened for the delay
+	var quiet <-chan time.Time
+	// lost is set until watching is reliable again after events have been lost
+	lost := false
+	overflowed := false
+	for {
+		select {
+		case <-w.stop:
+			return
+		case event := <-w.events:
+			// a new batch starts
+			if quiet == nil {
+				w.refresh()
+			}
+			w.collect(scopes, moves, event)
+			quiet = time.After(w.delay)
+		case <-w.overflow:
+			// events have been lost so only a full update is safe
+			w.model.warn("Watcher: events lost, will update completely!", Fields{Operation: "watch"})
+			scopes = map[string]bool{w.model.RootPath: true}
+			quiet = time.After(w.delay)
+			lost = true
+			overflowed = true
+		case <-quiet:
+			w.apply(scopes)
+			scopes = make(map[string]bool)
+			moves = make(map[uint32]string)
+			quiet = nil
+		case <-ticker.C:
+			// only required if we can't watch or events have been lost
+			if w.backend == nil || lost {
+				w.rewatch()
+				w.apply(map[string]bool{w.model.RootPath: true})
+			}
+			if lost && !overflowed && w.backend != nil {
+				w.model.info("Watcher: watching reestablished.", Fields{Operation: "watch"})
+				lost = false
+			}
+			overflowed = false
+		}
+	}
+}
+
+/*
+collect adds the scope of the event to the scopes to update.
+*/
+func (w *Watcher) collect(scopes map[string]bool, moves map[uint32]string, event watchEvent) {
+	if w.ignored(event.path) {
+		return
+	}
+	// new directories must be watched too
+	if event.directory && w.backend != nil {
+		err := w.addRecursive(event.path)
+		if err != nil {
+			w.fallback(err)
+		}
+	}
+	// the parent is the scope so that renames within a directory are detected as such
+	scope := filepath.Dir(event.path)
+	if event.cookie != 0 {
+		if event.movedFrom {
+			moves[event.cookie] = scope
+		} else if from, exists := moves[event.cookie]; exists {
+			// moves between directories must be within the same scope to be detected
+			scope = commonAncestor(from, scope)
+			delete(moves, event.cookie)
+		}
+	}
+	// events of the root itself must not leave the model
+	if !within(scope, w.model.RootPath) {
+		scope = w.model.RootPath
+	}
+	scopes[scope] = true
+}
+
+/*
+apply updates the model for the minimal set of scopes covering all given scopes.
+*/
+func (w *Watcher) apply(scopes map[string]bool) {
+	var sorted []string
+	for scope := range scopes {
+		sorted = append(sorted, scope)
+	}
+	sort.Strings(sorted)
+	var minimal []string
+	for _, scope := range sorted {
+		// sorted, so a covering scope is always the last one kept
+		if len(minimal) > 0 {
+			last := minimal[len(minimal)-1]
+			if scope == last || strings.HasPrefix(scope, last+"/") {
+				continue
+			}
+		}
+		minimal = append(minimal, scope)
+	}
+	for _, scope := range minimal {
+		err := w.model.PartialUpdate(scope)
+		if err != nil {
+			w.model.warn("Watcher: update failed!", Fields{Path: scope, Operation: "watch", Err: err})
+		}
+	}
+}
+
+/*
+addRecursive watches the directory and all directories within that aren't
+ignored. The matcher isn't refreshed, so the caller must do so once for the
+complete walk.
+*/
+func (w *Watcher) addRecursive(root string) error {
+	return filepath.Walk(root, func(path string, stat os.FileInfo, err error) error {
+		// may have been removed since, so ignore
+		if err != nil || !stat.IsDir() {
+			return nil
+		}
+		if w.ignored(path) {
+			return filepath.SkipDir
+		}
+		err = w.backend.add(path)
+		if errors.Is(err, errWatchLimit) {
+			return err
+		}
+		if err != nil {
+			w.model.warn("Watcher: failed to watch!", Fields{Path: path, Operation: "watch", Err: err})
+		}
+		return nil
+	})
+}
+
+/*
+rewatch watches all directories again, as directories created while events were
+lost are not watched yet. Does nothing if not watching.
+*/
+func (w *Watcher) rewatch() {
+	if w.backend == nil {
+		return
+	}
+	w.refresh()
+	err := w.addRecursive(w.model.RootPath)
+	if err != nil {
+		w.fallback(err)
+	}
+}
+
+/*
+fallback stops watching and switches to periodic updates.
+*/
+func (w *Watcher) fallback(err error) {
+	w.model.warn("Watcher: falling back to periodic updates!", Fields{Operation: "watch", Err: err})
+	w.backend.close()
+	w.backend = nil
+}
+
+/*
+refresh prepares the matcher for a new batch of events or a new walk. Within one
+batch the .tinignore files read already are trusted, see Matcher.Refresh, so it
+must not be called per path.
+*/
+func (w *Watcher) refresh() {
+	master, err := refreshMatcher(w.matcher, w.model.RootPath)
+	if err != nil {
+		w.model.warn("Watcher: failed to read ignore rules!", Fields{Operation: "watch", Err: err})
+		return
+	}
+	w.matcher = master
+}
+
+/*
+ignored returns true if changes of the path must not cause an update.
+*/
+func (w *Watcher) ignored(path string) bool {
+	// writing the model must not trigger updates, neither must incomplete transfers
+	tempDir := w.model.RootPath + "/" + shared.TINZENITEDIR + "/" + shared.TEMPDIR
+	if within(path, w.model.StorePath) || within(path, tempDir) {
+		return true
+	}
+	if w.matcher == nil {
+		return false
+	}
+	relPath := shared.CreatePathRoot(w.model.RootPath).Apply(path)
+	return w.matcher.Resolve(relPath).Ignore(relPath.FullPath())
+}
+
+/*
+within returns true if path is the directory or lies within it.
+*/
+func within(path, directory string) bool {
+	return path == directory || strings.HasPrefix(path, directory+"/")
+}
+
+/*
+commonAncestor returns the deepest directory containing both paths.
+*/
+func commonAncestor(first, second string) string {
+	for !within(second, first) && first != filepath.Dir(first) {
+		first = filepath.Dir(first)
+	}
+	return first
+}
@@ -0,0 +1,119 @@
+package model
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+/*
+inotifyMask are the events we watch for.
+*/
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY |
+	syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB | syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF |
+	syscall.IN_ONLYDIR
+
+/*
+inotifyBackend watches directories via inotify.
+*/
+type inotifyBackend struct {
+	fd       int
+	file     *os.File
+	events   chan<- watchEvent
+	overflow chan<- bool
+	stop     chan bool
+	mutex    sync.Mutex
+	watches  map[int32]string
+}
+
+/*
+newWatchBackend creates the inotify instance and starts reading its events.
+*/
+func newWatchBackend(events chan<- watchEvent, overflow chan<- bool) (watchBackend, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	backend := &inotifyBackend{
+		fd:       fd,
+		file:     os.NewFile(uintptr(fd), "inotify"),
+		events:   events,
+		overflow: overflow,
+		stop:     make(chan bool),
+		watches:  make(map[int32]string)}
+	go backend.read()
+	return backend, nil
+}
+
+func (b *inotifyBackend) add(path string) error {
+	wd, err := syscall.InotifyAddWatch(b.fd, path, inotifyMask)
+	if err == syscall.ENOSPC {
+		return errWatchLimit
+	}
+	if err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	b.watches[int32(wd)] = path
+	b.mutex.Unlock()
+	return nil
+}
+
+func (b *inotifyBackend) close() error {
+	close(b.stop)
+	// closing the file also ends the blocking read
+	return b.file.Close()
+}
+
+/*
+read parses the raw events until the backend is closed.
+*/
+func (b *inotifyBackend) read() {
+	buffer := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		read, err := b.file.Read(buffer)
+		if err != nil {
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= read; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			offset = start + int(raw.Len)
+			if raw.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				// non blocking: one pending overflow is enough
+				select {
+				case b.overflow <- true:
+				default:
+				}
+				continue
+			}
+			b.mutex.Lock()
+			directory, known := b.watches[raw.Wd]
+			// the kernel removed the watch (directory is gone)
+			if raw.Mask&syscall.IN_IGNORED != 0 {
+				delete(b.watches, raw.Wd)
+			}
+			b.mutex.Unlock()
+			if !known || raw.Mask&syscall.IN_IGNORED != 0 {
+				continue
+			}
+			path := directory
+			if raw.Len > 0 {
+				path += "/" + strings.TrimRight(string(buffer[start:offset]), "\x00")
+			}
+			event := watchEvent{
+				path:      path,
+				directory: raw.Mask&syscall.IN_ISDIR != 0 && raw.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0,
+				movedFrom: raw.Mask&syscall.IN_MOVED_FROM != 0,
+				cookie:    raw.Cookie}
+			select {
+			case b.events <- event:
+			case <-b.stop:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package model
+
+/*
+newWatchBackend is not supported on this platform, so the watcher always uses
+periodic updates.
+*/
+func newWatchBackend(events chan<- watchEvent, overflow chan<- bool) (watchBackend, error) {
+	return nil, errWatchUnsupported
+}